@@ -2,14 +2,68 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
 	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
 	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/provisioner"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	klog "k8s.io/klog/v2"
 )
 
 func main() {
+	var checkoutNamespace string
+	var pvcTemplates bool
+	var adoptOrphanedPVCs bool
+	var storageClassFallback bool
+	var metricsListen string
+	var namespacePolicy bool
+	var namespaceSelector string
+	var podSelector string
+	var webhookListen string
+	var webhookCertFile string
+	var webhookKeyFile string
+	var ungateOnBound bool
+	var orphanSweepInterval time.Duration
+	var orphanGracePeriod time.Duration
+	var ownerPassThroughKinds string
+
+	flag.BoolVar(&pvcTemplates, "pvc-templates", false, "optional, resolve PVCTemplate and ClusterPVCTemplate references; requires the CRDs to be installed")
+	flag.BoolVar(&adoptOrphanedPVCs, "adopt-orphaned-pvcs", false, "optional, take over existing PVCs with the requested name that have no controller")
+	flag.BoolVar(&storageClassFallback, "storage-class-fallback", false, "optional, let volumes list Storage Classes to fall back to")
+	flag.BoolVar(&namespacePolicy, "namespace-policy", false, "optional, restrict Storage Classes, claim size and number of claims with namespace annotations; requires permissions to watch namespaces")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "", "optional, watch only namespaces matching this label selector, i.e. pvc-pool=enabled; can't be used with -namespace")
+	flag.StringVar(&podSelector, "pod-selector", "", "optional, only watch pods matching this label selector, i.e. dynamic-pvc-provisioner.kubernetes.io/enabled=true")
+	flag.StringVar(&webhookListen, "webhook-listen", "", "optional, address to serve the mutating webhook that adds scheduling gates to pods, i.e. :8443")
+	flag.StringVar(&webhookCertFile, "webhook-tls-cert-file", "", "TLS certificate for the webhook; required with -webhook-listen")
+	flag.StringVar(&webhookKeyFile, "webhook-tls-key-file", "", "TLS key for the webhook; required with -webhook-listen")
+	flag.BoolVar(&ungateOnBound, "ungate-on-bound", false, "optional, keep the scheduling gate until requested PVCs are Bound instead of just created")
+	flag.DurationVar(&orphanSweepInterval, "orphan-sweep-interval", 0, "optional, how often to look for managed PVCs whose pod is gone; disabled by default")
+	flag.DurationVar(&orphanGracePeriod, "orphan-grace-period", provisioner.DefaultOrphanGracePeriod, "optional, how long a PVC must stay orphaned before it is deleted")
+	flag.StringVar(&metricsListen, "metrics-listen", "", "optional, address to serve cache hit/miss counters at /debug/vars, i.e. :8080")
+	flag.StringVar(&ownerPassThroughKinds, "owner-pass-through-kinds", strings.Join(provisioner.DefaultOwnerPassThroughKinds, ","), "optional, comma-separated controller kinds that are skipped in favor of their own controller when resolving owner: controller")
+	flag.StringVar(&checkoutNamespace, "checkout-namespace", "", "optional, namespace for Leases of volumes in checkout mode; defaults to the pod namespace")
+
+	passThroughKinds := func() []string {
+		kinds := []string{}
+		for _, kind := range strings.Split(ownerPassThroughKinds, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				kinds = append(kinds, kind)
+			}
+		}
+		return kinds
+	}
+	newRESTMapper := func(client *clientset.Clientset) *restmapper.DeferredDiscoveryRESTMapper {
+		return restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(client.Discovery()))
+	}
+
 	var c controller.Controller
 	run := func(
 		ctx context.Context,
@@ -19,7 +73,43 @@ func main() {
 		namespace string,
 		controllerId string,
 	) {
-		c = provisioner.New(ctx, client, namespace, controllerId)
+		opts := []provisioner.Option{
+			provisioner.WithDynamicClient(dynamic.NewForConfigOrDie(config)),
+			provisioner.WithRESTMapper(newRESTMapper(client)),
+			provisioner.WithOwnerPassThroughKinds(passThroughKinds()),
+			provisioner.WithCheckoutNamespace(checkoutNamespace),
+			provisioner.WithAdoptOrphanedPVCs(adoptOrphanedPVCs),
+			provisioner.WithUngateOnBound(ungateOnBound),
+			provisioner.WithOrphanSweep(orphanSweepInterval, orphanGracePeriod),
+		}
+		if pvcTemplates {
+			opts = append(opts, provisioner.WithPVCTemplates())
+		}
+		if namespacePolicy {
+			opts = append(opts, provisioner.WithNamespacePolicy())
+		}
+		if storageClassFallback {
+			opts = append(opts, provisioner.WithStorageClassFallback())
+		}
+		if namespaceSelector != "" {
+			if namespace != "" {
+				klog.Fatal("-namespace and -namespace-selector are mutually exclusive")
+			}
+			selector, err := labels.Parse(namespaceSelector)
+			if err != nil {
+				klog.Fatalf("Invalid -namespace-selector: %s", err.Error())
+			}
+			opts = append(opts, provisioner.WithNamespaceSelector(selector))
+		}
+		if podSelector != "" {
+			selector, err := labels.Parse(podSelector)
+			if err != nil {
+				klog.Fatalf("Invalid -pod-selector: %s", err.Error())
+			}
+			opts = append(opts, provisioner.WithPodSelector(selector))
+		}
+
+		c = provisioner.New(ctx, client, namespace, controllerId, opts...)
 		if err := c.Run(2, stopCh); err != nil {
 			klog.Fatalf("Error running provisioner: %s", err.Error())
 		}
@@ -29,5 +119,42 @@ func main() {
 			c.Stop()
 		}
 	}
-	controller.Main(run, stop)
+	webhook := func(
+		ctx context.Context,
+		stopCh <-chan struct{},
+		config *rest.Config,
+		client *clientset.Clientset,
+	) error {
+		if webhookListen == "" {
+			return nil
+		}
+		webhookConfig := &provisioner.WebhookConfig{
+			Addr:                  webhookListen,
+			CertFile:              webhookCertFile,
+			KeyFile:               webhookKeyFile,
+			DynamicClient:         dynamic.NewForConfigOrDie(config),
+			RESTMapper:            newRESTMapper(client),
+			OwnerPassThroughKinds: passThroughKinds(),
+		}
+		if podSelector != "" {
+			selector, err := labels.Parse(podSelector)
+			if err != nil {
+				return fmt.Errorf("invalid -pod-selector: %w", err)
+			}
+			webhookConfig.PodSelector = selector
+		}
+		return provisioner.ServeWebhook(webhookConfig, stopCh)
+	}
+	metrics := func(
+		ctx context.Context,
+		stopCh <-chan struct{},
+		config *rest.Config,
+		client *clientset.Clientset,
+	) error {
+		if metricsListen == "" {
+			return nil
+		}
+		return provisioner.ServeMetrics(metricsListen, stopCh)
+	}
+	controller.Main(run, stop, controller.WithService("webhook", webhook), controller.WithService("metrics", metrics))
 }
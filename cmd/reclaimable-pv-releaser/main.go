@@ -2,15 +2,50 @@ package main
 
 import (
 	"context"
+	"flag"
+	"time"
 
 	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
 	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/releaser"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	klog "k8s.io/klog/v2"
 )
 
 func main() {
+	var policyURL string
+	var policyTimeout time.Duration
+	var policyFailOpen bool
+	var policyCacheTTL time.Duration
+	var policyCAFile string
+	var policyCertFile string
+	var policyKeyFile string
+	var policyInsecureSkipVerify bool
+	var helperNamespace string
+	var probeImage string
+	var reservationListen string
+	var reservationTokenFile string
+	var reservationCertFile string
+	var reservationKeyFile string
+	var reservationNamespaces string
+
+	flag.StringVar(&policyURL, "policy-url", "", "optional, URL of an external policy service to consult before releasing a PV")
+	flag.DurationVar(&policyTimeout, "policy-timeout", 5*time.Second, "optional, timeout for a policy service request")
+	flag.BoolVar(&policyFailOpen, "policy-fail-open", false, "optional, release PVs when the policy service is unavailable")
+	flag.DurationVar(&policyCacheTTL, "policy-cache-ttl", time.Minute, "optional, how long to cache policy service verdicts; 0 to disable")
+	flag.StringVar(&policyCAFile, "policy-ca-file", "", "optional, CA bundle to verify the policy service certificate")
+	flag.StringVar(&policyCertFile, "policy-cert-file", "", "optional, client certificate for the policy service")
+	flag.StringVar(&policyKeyFile, "policy-key-file", "", "optional, client key for the policy service")
+	flag.BoolVar(&policyInsecureSkipVerify, "policy-insecure-skip-verify", false, "optional, do not verify the policy service certificate")
+	flag.StringVar(&helperNamespace, "helper-namespace", "", "optional, namespace for helper PVCs and Jobs to work with PV content; required for usage probes and snapshots")
+	flag.StringVar(&probeImage, "probe-image", "busybox", "optional, image for usage probe Jobs")
+	flag.StringVar(&reservationListen, "reservation-listen", "", "optional, address to serve the reservation API on, i.e. :8443; disabled if empty")
+	flag.StringVar(&reservationTokenFile, "reservation-token-file", "", "file with a bearer token reservation API clients must present; required with -reservation-listen")
+	flag.StringVar(&reservationCertFile, "reservation-tls-cert-file", "", "optional, certificate to serve the reservation API over TLS")
+	flag.StringVar(&reservationKeyFile, "reservation-tls-key-file", "", "optional, key to serve the reservation API over TLS")
+	flag.StringVar(&reservationNamespaces, "reservation-namespaces", "", "comma separated namespaces reserved PVs can be pre-bound to claims in; required with -reservation-listen")
+
 	var c controller.Controller
 	run := func(
 		ctx context.Context,
@@ -20,7 +55,48 @@ func main() {
 		namespace string,
 		controllerId string,
 	) {
-		c = releaser.New(ctx, client, namespace, controllerId)
+		opts := []releaser.Option{
+			releaser.WithHelperNamespace(helperNamespace),
+			releaser.WithProbeImage(probeImage),
+			releaser.WithDynamicClient(dynamic.NewForConfigOrDie(config)),
+		}
+
+		if policyURL != "" {
+			tlsConfig, err := releaser.NewTLSConfig(policyCAFile, policyCertFile, policyKeyFile, policyInsecureSkipVerify)
+			if err != nil {
+				klog.Fatalf("Error loading policy service TLS config: %s", err.Error())
+			}
+			policy, err := releaser.NewHTTPPolicy(releaser.HTTPPolicyConfig{
+				URL:       policyURL,
+				Timeout:   policyTimeout,
+				FailOpen:  policyFailOpen,
+				CacheTTL:  policyCacheTTL,
+				TLSConfig: tlsConfig,
+			})
+			if err != nil {
+				klog.Fatalf("Error creating policy service client: %s", err.Error())
+			}
+			opts = append(opts, releaser.WithPolicies(policy))
+		}
+
+		if reservationListen != "" {
+			if reservationTokenFile == "" {
+				klog.Fatal("-reservation-token-file is required with -reservation-listen")
+			}
+			namespaces := controller.SplitNamespaces(reservationNamespaces)
+			if len(namespaces) == 0 {
+				klog.Fatal("-reservation-namespaces is required with -reservation-listen")
+			}
+			opts = append(opts, releaser.WithReservationAPI(releaser.ReservationConfig{
+				Addr:       reservationListen,
+				TokenFile:  reservationTokenFile,
+				CertFile:   reservationCertFile,
+				KeyFile:    reservationKeyFile,
+				Namespaces: namespaces,
+			}))
+		}
+
+		c = releaser.New(ctx, client, namespace, controllerId, opts...)
 		if err := c.Run(2, stopCh); err != nil {
 			klog.Fatalf("Error running releaser: %s", err.Error())
 		}
@@ -30,5 +106,12 @@ func main() {
 			c.Stop()
 		}
 	}
-	controller.Main(run, stop)
+	controller.Main(
+		run,
+		stop,
+		controller.WithCommand("adopt", releaser.Adopt),
+		controller.WithCommand("migrate", releaser.Migrate),
+		controller.WithCommand("export", releaser.Export),
+		controller.WithCommand("import", releaser.Import),
+	)
 }
@@ -87,6 +87,47 @@ func buildConfig(kubeconfig string) (*rest.Config, error) {
 	return cfg, nil
 }
 
+// Command is a one-off operation that runs instead of the controller, i.e. `reclaimable-pv-releaser adopt ...`.
+// It gets the arguments following its name and is not subject to leader election.
+type Command func(
+	ctx context.Context,
+	config *rest.Config,
+	client clientset.Interface,
+	controllerId string,
+	args []string,
+) error
+
+// Service runs alongside the controller on every replica regardless of leader election, i.e. an admission webhook.
+// It must return once stopCh is closed.
+type Service func(
+	ctx context.Context,
+	stopCh <-chan struct{},
+	config *rest.Config,
+	client *clientset.Clientset,
+) error
+
+type mainOptions struct {
+	commands map[string]Command
+	services map[string]Service
+}
+
+// MainOption configures optional Main behavior.
+type MainOption func(*mainOptions)
+
+// WithService registers a Service under the name, a failing Service terminates the process.
+func WithService(name string, service Service) MainOption {
+	return func(o *mainOptions) {
+		o.services[name] = service
+	}
+}
+
+// WithCommand registers a Command under the name.
+func WithCommand(name string, command Command) MainOption {
+	return func(o *mainOptions) {
+		o.commands[name] = command
+	}
+}
+
 func Main(
 	run func(
 		ctx context.Context,
@@ -100,10 +141,19 @@ func Main(
 		config *rest.Config,
 		client *clientset.Clientset,
 	),
+	opts ...MainOption,
 ) {
 	klog.InitFlags(nil)
 	defer klog.Flush()
 
+	options := &mainOptions{
+		commands: make(map[string]Command),
+		services: make(map[string]Service),
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+
 	var kubeconfig string
 	var controllerId string
 	var namespace string
@@ -113,10 +163,10 @@ func Main(
 
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "optional, absolute path to the kubeconfig file")
 	flag.StringVar(&controllerId, "controller-id", "", "this controller identity name - use the same string for both provisioner and releaser")
-	flag.StringVar(&namespace, "namespace", "", "limit to a specific namespace - only for provisioner")
+	flag.StringVar(&namespace, "namespace", "", "limit to a specific namespace or a comma-separated list of namespaces - only for provisioner")
 	flag.StringVar(&leaseLockId, "lease-lock-id", uuid.New().String(), "optional, the lease lock holder identity name")
 	flag.StringVar(&leaseLockName, "lease-lock-name", "", "the lease lock resource name")
-	flag.StringVar(&leaseLockNamespace, "lease-lock-namespace", "", "optional, the lease lock resource namespace; default to -namespace")
+	flag.StringVar(&leaseLockNamespace, "lease-lock-namespace", "", "optional, the lease lock resource namespace; default to -namespace if it is a single namespace")
 	flag.Parse()
 
 	flag.Visit(func(f *flag.Flag) {
@@ -133,8 +183,8 @@ func Main(
 		klog.Fatal("unable to get controller id (missing controller-id flag).")
 	}
 
-	if leaseLockNamespace == "" {
-		leaseLockNamespace = namespace
+	if leaseLockNamespace == "" && len(SplitNamespaces(namespace)) == 1 {
+		leaseLockNamespace = SplitNamespaces(namespace)[0]
 	}
 
 	config, err := buildConfig(kubeconfig)
@@ -146,6 +196,19 @@ func Main(
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Arguments are only parsed as a command by binaries that have any, Provisioner ignores them
+	if len(options.commands) > 0 && len(flag.Args()) > 0 {
+		name := flag.Args()[0]
+		command, ok := options.commands[name]
+		if !ok {
+			klog.Fatalf("unknown command %q", name)
+		}
+		if err := command(ctx, config, client, controllerId, flag.Args()[1:]); err != nil {
+			klog.Fatalf("%s: %s", name, err.Error())
+		}
+		return
+	}
+
 	stopElectCh := make(chan struct{})
 	stopCh := signals.SetupSignalHandler()
 	go func() {
@@ -155,6 +218,15 @@ func Main(
 		cancel()
 	}()
 
+	for name, service := range options.services {
+		go func(name string, service Service) {
+			klog.V(2).Infof("Starting service %s", name)
+			if err := service(ctx, stopCh, config, client); err != nil {
+				klog.Fatalf("%s: %s", name, err.Error())
+			}
+		}(name, service)
+	}
+
 	leader.Elect(&leader.Config{
 		LeaseLockName:      leaseLockName,
 		LeaseLockNamespace: leaseLockNamespace,
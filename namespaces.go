@@ -0,0 +1,228 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	klog "k8s.io/klog/v2"
+)
+
+// SplitNamespaces parses a comma-separated list of namespaces, empty means all namespaces.
+func SplitNamespaces(value string) []string {
+	namespaces := []string{}
+	for _, namespace := range strings.Split(value, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// NamespaceSetup registers informers and event handlers with the factory of a newly watched namespace.
+// It returns what must be synced before the namespace is considered ready.
+type NamespaceSetup func(namespace string, factory kubeinformers.SharedInformerFactory) []cache.InformerSynced
+
+type namespaceInformer struct {
+	factory kubeinformers.SharedInformerFactory
+	synced  []cache.InformerSynced
+	stopCh  chan struct{}
+}
+
+// NamespaceInformers keeps an informer factory per watched namespace.
+// Namespaces are either a static list, all namespaces when the list is empty,
+// or Namespace objects matching a label selector - those are added and removed as their labels change.
+type NamespaceInformers struct {
+	client     kubernetes.Interface
+	resync     time.Duration
+	namespaces []string
+	selector   labels.Selector
+
+	mutex     sync.RWMutex
+	informers map[string]*namespaceInformer
+	setups    []NamespaceSetup
+}
+
+func NewNamespaceInformers(
+	client kubernetes.Interface,
+	resync time.Duration,
+	namespaces []string,
+	selector labels.Selector,
+) *NamespaceInformers {
+	return &NamespaceInformers{
+		client:     client,
+		resync:     resync,
+		namespaces: namespaces,
+		selector:   selector,
+		informers:  make(map[string]*namespaceInformer),
+	}
+}
+
+// AddSetup registers a NamespaceSetup, must be called before Start.
+func (n *NamespaceInformers) AddSetup(setup NamespaceSetup) {
+	n.setups = append(n.setups, setup)
+}
+
+// Start begins watching namespaces until stopCh is closed.
+// With a selector it waits for the Namespace cache to sync, so that all matching namespaces are known when it returns.
+func (n *NamespaceInformers) Start(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		for namespace := range n.informers {
+			n.remove(namespace)
+		}
+	}()
+
+	if n.selector == nil {
+		if len(n.namespaces) == 0 {
+			n.Add(metav1.NamespaceAll)
+		}
+		for _, namespace := range n.namespaces {
+			n.Add(namespace)
+		}
+		return
+	}
+
+	klog.V(2).Infof("Watching namespaces matching %s", n.selector.String())
+	factory := kubeinformers.NewSharedInformerFactoryWithOptions(
+		n.client,
+		n.resync,
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = n.selector.String()
+		}),
+	)
+	informer := factory.Core().V1().Namespaces().Informer()
+	registration, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if namespace, ok := obj.(*corev1.Namespace); ok {
+				n.Add(namespace.ObjectMeta.Name)
+			}
+		},
+		// Namespaces that no longer match the selector are delivered as deleted
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if namespace, ok := obj.(*corev1.Namespace); ok {
+				n.Remove(namespace.ObjectMeta.Name)
+			}
+		},
+	})
+	if err != nil {
+		klog.Errorf("Failed to watch namespaces: %s", err.Error())
+		return
+	}
+	factory.Start(stopCh)
+	// Registration is synced once the handler has seen all existing namespaces
+	cache.WaitForCacheSync(stopCh, registration.HasSynced)
+}
+
+// Add starts watching the namespace, it is a no-op if it is already watched.
+func (n *NamespaceInformers) Add(namespace string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.informers[namespace]; ok {
+		return
+	}
+
+	klog.Infof("Start watching namespace %q", namespace)
+	options := []kubeinformers.SharedInformerOption{}
+	if namespace != metav1.NamespaceAll {
+		options = append(options, kubeinformers.WithNamespace(namespace))
+	}
+	informer := &namespaceInformer{
+		factory: kubeinformers.NewSharedInformerFactoryWithOptions(n.client, n.resync, options...),
+		stopCh:  make(chan struct{}),
+	}
+	for _, setup := range n.setups {
+		informer.synced = append(informer.synced, setup(namespace, informer.factory)...)
+	}
+	informer.factory.Start(informer.stopCh)
+	n.informers[namespace] = informer
+}
+
+// Remove stops watching the namespace.
+func (n *NamespaceInformers) Remove(namespace string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.remove(namespace)
+}
+
+func (n *NamespaceInformers) remove(namespace string) {
+	informer, ok := n.informers[namespace]
+	if !ok {
+		return
+	}
+	klog.Infof("Stop watching namespace %q", namespace)
+	close(informer.stopCh)
+	delete(n.informers, namespace)
+	go informer.factory.Shutdown()
+}
+
+// Factory returns the informer factory that watches the namespace, nil if the namespace is not watched.
+func (n *NamespaceInformers) Factory(namespace string) kubeinformers.SharedInformerFactory {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if informer, ok := n.informers[metav1.NamespaceAll]; ok {
+		return informer.factory
+	}
+	if informer, ok := n.informers[namespace]; ok {
+		return informer.factory
+	}
+	return nil
+}
+
+// Namespaces returns watched namespaces in order, a single empty string means all namespaces.
+func (n *NamespaceInformers) Namespaces() []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	namespaces := make([]string, 0, len(n.informers))
+	for namespace := range n.informers {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// HasSynced returns true if informers of all currently watched namespaces are synced.
+func (n *NamespaceInformers) HasSynced() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	for _, informer := range n.informers {
+		for _, synced := range informer.synced {
+			if !synced() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// NamespaceSynced returns true if informers watching the namespace are synced, false if it is not watched.
+// Namespaces added after Start are synced in the background, so their objects may arrive before the rest of the caches.
+func (n *NamespaceInformers) NamespaceSynced(namespace string) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	informer, ok := n.informers[metav1.NamespaceAll]
+	if !ok {
+		informer, ok = n.informers[namespace]
+	}
+	if !ok {
+		return false
+	}
+	for _, synced := range informer.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
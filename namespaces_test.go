@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSplitNamespaces(t *testing.T) {
+	tests := map[string][]string{
+		"":              {},
+		"default":       {"default"},
+		" a, b ,,c ":    {"a", "b", "c"},
+		",":             {},
+		"team-a,team-b": {"team-a", "team-b"},
+	}
+	for value, want := range tests {
+		if got := SplitNamespaces(value); !reflect.DeepEqual(got, want) {
+			t.Errorf("SplitNamespaces(%q): expected %v, got %v", value, want, got)
+		}
+	}
+}
+
+func TestNamespaceSynced(t *testing.T) {
+	synced := map[string]*atomic.Bool{}
+	informers := NewNamespaceInformers(fake.NewSimpleClientset(), 0, nil, nil)
+	informers.AddSetup(func(namespace string, factory kubeinformers.SharedInformerFactory) []cache.InformerSynced {
+		synced[namespace] = &atomic.Bool{}
+		return []cache.InformerSynced{synced[namespace].Load}
+	})
+	defer func() {
+		for _, namespace := range informers.Namespaces() {
+			informers.Remove(namespace)
+		}
+	}()
+
+	informers.Add("team-a")
+	informers.Add("team-b")
+	if informers.NamespaceSynced("team-a") || informers.HasSynced() {
+		t.Fatal("expected nothing to be synced yet")
+	}
+
+	synced["team-a"].Store(true)
+	if !informers.NamespaceSynced("team-a") {
+		t.Error("expected team-a to be synced")
+	}
+	if informers.NamespaceSynced("team-b") {
+		t.Error("expected team-b not to be synced")
+	}
+	if informers.HasSynced() {
+		t.Error("expected HasSynced to wait for team-b")
+	}
+	if informers.NamespaceSynced("team-c") {
+		t.Error("expected namespace that is not watched not to be synced")
+	}
+
+	synced["team-b"].Store(true)
+	if !informers.HasSynced() {
+		t.Error("expected all namespaces to be synced")
+	}
+}
+
+func TestNamespaceSyncedAllNamespaces(t *testing.T) {
+	synced := &atomic.Bool{}
+	informers := NewNamespaceInformers(fake.NewSimpleClientset(), 0, nil, nil)
+	informers.AddSetup(func(namespace string, factory kubeinformers.SharedInformerFactory) []cache.InformerSynced {
+		return []cache.InformerSynced{synced.Load}
+	})
+	informers.Add(metav1.NamespaceAll)
+	defer informers.Remove(metav1.NamespaceAll)
+
+	if informers.NamespaceSynced("team-a") {
+		t.Error("expected team-a not to be synced")
+	}
+	synced.Store(true)
+	if !informers.NamespaceSynced("team-a") {
+		t.Error("expected any namespace to be synced with all namespaces watched")
+	}
+	if informers.Factory("team-a") == nil {
+		t.Error("expected all namespaces factory to watch team-a")
+	}
+}
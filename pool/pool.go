@@ -0,0 +1,49 @@
+// Package pool has the names Releaser puts on the pool and its helper objects, that Provisioner relies on to consume it.
+package pool
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// ReleaserName is the agent name of the Releaser, that owns the annotations and labels below
+	ReleaserName = "reclaimable-pv-releaser"
+
+	AnnotationBaseName = ReleaserName + ".kubernetes.io"
+	LabelBaseName      = AnnotationBaseName
+
+	// Storage Class annotations
+	AnnotationControllerIdKey = "controller-id"
+	AnnotationControllerId    = AnnotationBaseName + "/" + AnnotationControllerIdKey
+	// AnnotationGoldenSnapshotNamespace is where golden snapshots are kept, they can only seed PVCs there
+	AnnotationGoldenSnapshotNamespaceKey = "golden-snapshot-namespace"
+	AnnotationGoldenSnapshotNamespace    = AnnotationBaseName + "/" + AnnotationGoldenSnapshotNamespaceKey
+
+	// PV annotations
+	AnnotationReleaseCountKey = "release-count"
+	AnnotationReleaseCount    = AnnotationBaseName + "/" + AnnotationReleaseCountKey
+	// AnnotationReservationId marks a PV reserved through the Releaser reservation API
+	AnnotationReservationIdKey = "reservation-id"
+	AnnotationReservationId    = AnnotationBaseName + "/" + AnnotationReservationIdKey
+
+	// Labels of helper PVCs and snapshots
+	LabelManagedByKey    = "managed-by"
+	LabelManagedBy       = LabelBaseName + "/" + LabelManagedByKey
+	LabelHelperKey       = "helper"
+	LabelHelper          = LabelBaseName + "/" + LabelHelperKey
+	LabelStorageClassKey = "storage-class"
+	LabelStorageClass    = LabelBaseName + "/" + LabelStorageClassKey
+	LabelSnapshotKey     = "snapshot"
+	LabelSnapshot        = LabelBaseName + "/" + LabelSnapshotKey
+
+	// HelperClone is a LabelHelper value of PVCs that can be used as a clone source
+	HelperClone = "clone"
+	// SnapshotGolden is a LabelSnapshot value of snapshots that can seed new PVCs
+	SnapshotGolden = "golden"
+)
+
+var VolumeSnapshotResource = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
@@ -0,0 +1,156 @@
+package provisioner
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// PVC annotations
+	AnnotationCacheKey = "cache"
+	AnnotationCache    = AnnotationBaseName + "/" + AnnotationCacheKey
+
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+
+	MessageCacheHit = "cache hit: PV %s reused %d times"
+	// Pre-provisioned PVs that were never released yet are hits too
+	MessageCacheHitNew = "cache hit: PV %s is older than the PVC"
+	MessageCacheMiss   = "cache miss: PV %s was provisioned for the PVC"
+	CacheReport        = "CacheReport"
+)
+
+// Cache hits and misses per `<namespace>/<storage class>`, published at /debug/vars.
+var (
+	cacheHits   = expvar.NewMap("provisioner_cache_hits")
+	cacheMisses = expvar.NewMap("provisioner_cache_misses")
+)
+
+// ServeMetrics serves expvar counters at /debug/vars until stopCh is closed.
+// It runs on every replica, counters of the replicas that are not leading stay at zero.
+func ServeMetrics(addr string, stopCh <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Warningf("Failed to shut down metrics: %s", err)
+		}
+	}()
+
+	klog.Infof("Serving metrics on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// enqueueBoundPVC queues PVCs provisioned by this controller that got bound and were not reported yet.
+func (p *Provisioner) enqueueBoundPVC(obj interface{}) {
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	if pvc.ObjectMeta.Labels[LabelManagedBy] != p.ControllerId || pvc.Status.Phase != corev1.ClaimBound {
+		return
+	}
+	if _, ok := pvc.ObjectMeta.Annotations[AnnotationCache]; ok {
+		return
+	}
+	p.Enqueue(p.PVCQueue, obj)
+}
+
+// pvcSyncHandler tells whether the PV bound to our PVC was reused from the pool or newly provisioned.
+func (p *Provisioner) pvcSyncHandler(namespace, name string) error {
+	pvc, err := p.PVCLister.PersistentVolumeClaims(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			utilruntime.HandleError(
+				fmt.Errorf("pvc '%s/%s' in work queue no longer exists", namespace, name),
+			)
+			return nil
+		}
+
+		return err
+	}
+	if _, ok := pvc.ObjectMeta.Annotations[AnnotationCache]; ok || pvc.Spec.VolumeName == "" {
+		return nil
+	}
+
+	pv, err := p.PVLister.Get(pvc.Spec.VolumeName)
+	if errors.IsNotFound(err) {
+		klog.V(5).Infof("PV %s of PVC %s/%s is gone, skip", pvc.Spec.VolumeName, namespace, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	result := CacheMiss
+	message := fmt.Sprintf(MessageCacheMiss, pv.ObjectMeta.Name)
+	releaseCount, _ := strconv.Atoi(pv.ObjectMeta.Annotations[pool.AnnotationReleaseCount])
+	switch {
+	case releaseCount > 0:
+		result = CacheHit
+		message = fmt.Sprintf(MessageCacheHit, pv.ObjectMeta.Name, releaseCount)
+	case pv.ObjectMeta.CreationTimestamp.Before(&pvc.ObjectMeta.CreationTimestamp):
+		result = CacheHit
+		message = fmt.Sprintf(MessageCacheHitNew, pv.ObjectMeta.Name)
+	}
+
+	pvcCopy := pvc.DeepCopy()
+	if pvcCopy.ObjectMeta.Annotations == nil {
+		pvcCopy.ObjectMeta.Annotations = make(map[string]string)
+	}
+	pvcCopy.ObjectMeta.Annotations[AnnotationCache] = result
+	_, err = p.KubeClientSet.CoreV1().PersistentVolumeClaims(namespace).Update(p.Ctx, pvcCopy, metav1.UpdateOptions{})
+	if err != nil {
+		if errors.IsConflict(err) {
+			klog.V(4).Infof("PVC %s/%s had a conflict - ignore it, it will be queued again with a new version", namespace, name)
+			return nil
+		}
+		return err
+	}
+
+	storageClass := ""
+	if pvc.Spec.StorageClassName != nil {
+		storageClass = *pvc.Spec.StorageClassName
+	}
+	key := fmt.Sprintf("%s/%s", namespace, storageClass)
+	if result == CacheHit {
+		cacheHits.Add(key, 1)
+	} else {
+		cacheMisses.Add(key, 1)
+	}
+	klog.V(4).Infof("PVC %s/%s %s", namespace, name, message)
+
+	// Report on the pod if it owns the PVC, otherwise on the PVC itself
+	var object runtime.Object = pvc
+	if owner := metav1.GetControllerOf(pvc); owner != nil && owner.Kind == "Pod" {
+		if pod, err := p.PodsLister.Pods(namespace).Get(owner.Name); err == nil && pod.ObjectMeta.UID == owner.UID {
+			object = pod
+		}
+	}
+	p.Recorder.Event(object, corev1.EventTypeNormal, CacheReport, message)
+	return nil
+}
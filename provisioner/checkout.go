@@ -0,0 +1,343 @@
+package provisioner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Checkout mode gives ReadWriteMany pool volumes the same one-consumer-at-a-time semantics as ReadWriteOnce.
+// Provisioner holds a Lease per pooled PV for as long as the pod that checked it out is alive.
+const (
+	ModeCheckout = "checkout"
+
+	// Lease annotations
+	AnnotationPodUIDKey = "pod-uid"
+	AnnotationPodUID    = AnnotationBaseName + "/" + AnnotationPodUIDKey
+	AnnotationClaimKey  = "claim"
+	AnnotationClaim     = AnnotationBaseName + "/" + AnnotationClaimKey
+
+	LabelStorageClassKey = "storage-class"
+	LabelStorageClass    = LabelBaseName + "/" + LabelStorageClassKey
+	LabelPVKey           = "pv"
+	LabelPV              = LabelBaseName + "/" + LabelPVKey
+
+	CheckoutWaitInterval = 30 * time.Second
+
+	checkoutPrefix = "checkout"
+
+	MessageCheckoutWaiting = "'%s' waiting for a free volume in SC %s"
+	CheckoutWaiting        = "CheckoutWaiting"
+
+	MessageCheckoutPV = "'%s' checked out PV %s"
+	CheckedOut        = "CheckedOut"
+
+	MessageCheckout = "'%s' failed to check out a volume: %s"
+	ErrCheckout     = "ErrCheckout"
+)
+
+// WithCheckoutNamespace sets the namespace to keep checkout Leases in, defaults to the pod namespace.
+func WithCheckoutNamespace(namespace string) Option {
+	return func(p *Provisioner) {
+		p.CheckoutNamespace = namespace
+	}
+}
+
+// checkoutName generates a DNS label safe Lease name for the PV.
+func checkoutName(pvName string) string {
+	name := fmt.Sprintf("%s-%s", checkoutPrefix, pvName)
+	if len(name) <= 63 {
+		return name
+	}
+	sum := sha256.Sum256([]byte(pvName))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return strings.TrimRight(name[:63-len(hash)-1], "-.") + "-" + hash
+}
+
+func podHolderIdentity(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+// checkout acquires a Lease on a free RWX PV of the PVC Storage Class and pre-binds the PVC to it.
+// Returns false if there is no free PV at the moment.
+func (p *Provisioner) checkout(pod *corev1.Pod, volumeName string, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, fmt.Errorf("storageClassName must be set")
+	}
+	storageClass := *pvc.Spec.StorageClassName
+	namespace := p.CheckoutNamespace
+	if namespace == "" {
+		namespace = pod.ObjectMeta.Namespace
+	}
+	holder := podHolderIdentity(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+	leases := p.KubeClientSet.CoordinationV1().Leases(namespace)
+
+	held, err := leases.List(p.Ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			LabelManagedBy:    p.ControllerId,
+			LabelStorageClass: storageClass,
+		}).String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	leaseByPV := map[string]*coordinationv1.Lease{}
+	for i, lease := range held.Items {
+		pvName := lease.ObjectMeta.Labels[LabelPV]
+		leaseByPV[pvName] = &held.Items[i]
+		// Pod was queued again before its PVC was created
+		if p.holds(&lease, holder, pod.ObjectMeta.UID) && lease.ObjectMeta.Annotations[AnnotationClaim] == pvc.ObjectMeta.Name {
+			pvc.Spec.VolumeName = pvName
+			return true, nil
+		}
+	}
+
+	pvs, err := p.PVLister.List(labels.Everything())
+	if err != nil {
+		return false, err
+	}
+	candidates := []*corev1.PersistentVolume{}
+	for _, pv := range pvs {
+		if pv.Spec.StorageClassName != storageClass || pv.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if !hasAccessMode(pv.Spec.AccessModes, corev1.ReadWriteMany) {
+			continue
+		}
+		if !checkoutFree(pv, pod.ObjectMeta.Namespace, pvc.ObjectMeta.Name) {
+			continue
+		}
+		candidates = append(candidates, pv)
+	}
+	// Prefer a volume that was already pre-bound to this PVC
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Spec.ClaimRef != nil && candidates[j].Spec.ClaimRef == nil
+	})
+
+	for _, pv := range candidates {
+		acquired, err := p.acquire(namespace, pv, storageClass, holder, pod, pvc, leaseByPV[pv.ObjectMeta.Name])
+		if err != nil {
+			return false, err
+		}
+		if !acquired {
+			continue
+		}
+
+		pvc.Spec.VolumeName = pv.ObjectMeta.Name
+		p.Recorder.Event(pod, corev1.EventTypeNormal, CheckedOut, fmt.Sprintf(MessageCheckoutPV, volumeName, pv.ObjectMeta.Name))
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// checkoutFree returns true if the PV can be checked out for the claim: it is Available, not reserved,
+// and either unclaimed or already pre-bound to this very claim. A Bound PV is left alone even if its Lease expired,
+// as its PVC still exists until Releaser releases it.
+func checkoutFree(pv *corev1.PersistentVolume, namespace, claimName string) bool {
+	if pv.Status.Phase != corev1.VolumeAvailable {
+		return false
+	}
+	if _, reserved := pv.ObjectMeta.Annotations[pool.AnnotationReservationId]; reserved {
+		return false
+	}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		return ref.Namespace == namespace && ref.Name == claimName && ref.UID == ""
+	}
+	return true
+}
+
+// acquire takes the Lease for the PV if it is free, concurrent attempts are resolved by the API server.
+func (p *Provisioner) acquire(
+	namespace string,
+	pv *corev1.PersistentVolume,
+	storageClass, holder string,
+	pod *corev1.Pod,
+	pvc *corev1.PersistentVolumeClaim,
+	existing *coordinationv1.Lease,
+) (bool, error) {
+	leases := p.KubeClientSet.CoordinationV1().Leases(namespace)
+	now := metav1.NewMicroTime(time.Now())
+
+	if existing == nil {
+		_, err := leases.Create(p.Ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      checkoutName(pv.ObjectMeta.Name),
+				Namespace: namespace,
+				Labels: map[string]string{
+					LabelManagedBy:    p.ControllerId,
+					LabelStorageClass: storageClass,
+					LabelPV:           pv.ObjectMeta.Name,
+				},
+				Annotations: map[string]string{
+					AnnotationPodUID: string(pod.ObjectMeta.UID),
+					AnnotationClaim:  pvc.ObjectMeta.Name,
+				},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity: &holder,
+				AcquireTime:    &now,
+				RenewTime:      &now,
+			},
+		}, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		klog.V(4).Infof("Pod %s checked out PV %s", holder, pv.ObjectMeta.Name)
+		return true, nil
+	}
+
+	if !p.expired(existing) {
+		return false, nil
+	}
+
+	lease := existing.DeepCopy()
+	if lease.ObjectMeta.Annotations == nil {
+		lease.ObjectMeta.Annotations = make(map[string]string)
+	}
+	lease.ObjectMeta.Annotations[AnnotationPodUID] = string(pod.ObjectMeta.UID)
+	lease.ObjectMeta.Annotations[AnnotationClaim] = pvc.ObjectMeta.Name
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	transitions := int32(1)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions = *lease.Spec.LeaseTransitions + 1
+	}
+	lease.Spec.LeaseTransitions = &transitions
+	// Update is guarded by resourceVersion, so only one pod takes over a free Lease
+	if _, err := leases.Update(p.Ctx, lease, metav1.UpdateOptions{}); err != nil {
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	klog.V(4).Infof("Pod %s checked out PV %s", holder, pv.ObjectMeta.Name)
+	return true, nil
+}
+
+// holds returns true if the Lease is held by the pod.
+func (p *Provisioner) holds(lease *coordinationv1.Lease, holder string, uid types.UID) bool {
+	return lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == holder &&
+		lease.ObjectMeta.Annotations[AnnotationPodUID] == string(uid)
+}
+
+// expired returns true if the Lease was released or the pod holding it is gone or terminated.
+func (p *Provisioner) expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return true
+	}
+	namespace, name, ok := strings.Cut(*lease.Spec.HolderIdentity, "/")
+	if !ok {
+		return true
+	}
+	pod, err := p.PodsLister.Pods(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		// Better wait than give the same volume to two pods
+		klog.Warningf("Failed to check holder of Lease %s/%s: %s", lease.ObjectMeta.Namespace, lease.ObjectMeta.Name, err)
+		return false
+	}
+	if string(pod.ObjectMeta.UID) != lease.ObjectMeta.Annotations[AnnotationPodUID] {
+		return true
+	}
+	return podTerminated(pod)
+}
+
+// releaseCheckouts releases Leases held by the pod, so the next pod doesn't have to wait for it to be gone.
+func (p *Provisioner) releaseCheckouts(pod *corev1.Pod) error {
+	namespace := p.CheckoutNamespace
+	if namespace == "" {
+		namespace = pod.ObjectMeta.Namespace
+	}
+	holder := podHolderIdentity(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+	leases := p.KubeClientSet.CoordinationV1().Leases(namespace)
+
+	list, err := leases.List(p.Ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{LabelManagedBy: p.ControllerId}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, lease := range list.Items {
+		if !p.holds(&lease, holder, pod.ObjectMeta.UID) {
+			continue
+		}
+		released := lease.DeepCopy()
+		released.Spec.HolderIdentity = nil
+		if _, err := leases.Update(p.Ctx, released, metav1.UpdateOptions{}); err != nil && !errors.IsConflict(err) {
+			return err
+		}
+		klog.V(4).Infof("Pod %s released PV %s", holder, lease.ObjectMeta.Labels[LabelPV])
+	}
+	return nil
+}
+
+// releaseCheckout releases the Lease the pod holds for the PVC pre-bound PV, if any.
+func (p *Provisioner) releaseCheckout(pod *corev1.Pod, pvc *corev1.PersistentVolumeClaim) error {
+	namespace := p.CheckoutNamespace
+	if namespace == "" {
+		namespace = pod.ObjectMeta.Namespace
+	}
+	holder := podHolderIdentity(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+	leases := p.KubeClientSet.CoordinationV1().Leases(namespace)
+
+	lease, err := leases.Get(p.Ctx, checkoutName(pvc.Spec.VolumeName), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !p.holds(lease, holder, pod.ObjectMeta.UID) || lease.ObjectMeta.Annotations[AnnotationClaim] != pvc.ObjectMeta.Name {
+		return nil
+	}
+	released := lease.DeepCopy()
+	released.Spec.HolderIdentity = nil
+	if _, err := leases.Update(p.Ctx, released, metav1.UpdateOptions{}); err != nil && !errors.IsConflict(err) {
+		return err
+	}
+	klog.V(4).Infof("Pod %s released PV %s", holder, pvc.Spec.VolumeName)
+	return nil
+}
+
+// usesCheckout returns true if any of the pod volumes is in checkout mode.
+func usesCheckout(pod *corev1.Pod) bool {
+	requests, _ := parseVolumeRequests(pod)
+	for _, request := range requests {
+		if request.Options[AnnotationModeKey] == ModeCheckout {
+			return true
+		}
+	}
+	return false
+}
+
+func podTerminated(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+func hasAccessMode(modes []corev1.PersistentVolumeAccessMode, mode corev1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func checkoutTestPV(phase corev1.PersistentVolumePhase, claimRef *corev1.ObjectReference, annotations map[string]string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv", Annotations: annotations},
+		Spec:       corev1.PersistentVolumeSpec{ClaimRef: claimRef},
+		Status:     corev1.PersistentVolumeStatus{Phase: phase},
+	}
+}
+
+func TestCheckoutFree(t *testing.T) {
+	tests := []struct {
+		name string
+		pv   *corev1.PersistentVolume
+		want bool
+	}{
+		{
+			name: "available",
+			pv:   checkoutTestPV(corev1.VolumeAvailable, nil, nil),
+			want: true,
+		},
+		{
+			name: "pre-bound to this claim",
+			pv:   checkoutTestPV(corev1.VolumeAvailable, &corev1.ObjectReference{Namespace: "default", Name: "cache"}, nil),
+			want: true,
+		},
+		{
+			name: "pre-bound to another claim",
+			pv:   checkoutTestPV(corev1.VolumeAvailable, &corev1.ObjectReference{Namespace: "default", Name: "other"}, nil),
+		},
+		{
+			name: "pre-bound to this claim name in another namespace",
+			pv:   checkoutTestPV(corev1.VolumeAvailable, &corev1.ObjectReference{Namespace: "other", Name: "cache"}, nil),
+		},
+		{
+			name: "reserved",
+			pv:   checkoutTestPV(corev1.VolumeAvailable, nil, map[string]string{pool.AnnotationReservationId: "id"}),
+		},
+		{
+			name: "reserved for this claim",
+			pv: checkoutTestPV(corev1.VolumeAvailable, &corev1.ObjectReference{Namespace: "default", Name: "cache"},
+				map[string]string{pool.AnnotationReservationId: "id"}),
+		},
+		{
+			name: "bound to a previous claim with the same name",
+			pv:   checkoutTestPV(corev1.VolumeBound, &corev1.ObjectReference{Namespace: "default", Name: "cache", UID: "old"}, nil),
+		},
+		{
+			name: "bound to the claim of a terminated pod",
+			pv:   checkoutTestPV(corev1.VolumeBound, &corev1.ObjectReference{Namespace: "default", Name: "other", UID: "uid"}, nil),
+		},
+		{
+			name: "released",
+			pv:   checkoutTestPV(corev1.VolumeReleased, &corev1.ObjectReference{Namespace: "default", Name: "other", UID: "uid"}, nil),
+		},
+		{
+			name: "failed",
+			pv:   checkoutTestPV(corev1.VolumeFailed, nil, nil),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkoutFree(test.pv, "default", "cache"); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
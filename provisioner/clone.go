@@ -0,0 +1,101 @@
+package provisioner
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Pod annotations
+	AnnotationModeKey = "mode"
+
+	ModeExclusive = "exclusive"
+	ModeClone     = "clone"
+
+	MessageCloneSource = "'%s' failed to find a clone source: %s"
+	ErrCloneSource     = "ErrCloneSource"
+
+	// A clone source problem is reported once per pod volume rather than on every sync of the pod
+	cloneReportsSize = 1024
+	cloneReportsTTL  = time.Hour
+)
+
+// releaserOf returns the controller ID of the Releaser the Storage Class is associated with,
+// only helper objects labeled with it may be used for the Storage Class.
+func (p *Provisioner) releaserOf(storageClass string) (string, error) {
+	sc, err := p.SCLister.Get(storageClass)
+	if err != nil {
+		return "", err
+	}
+	releaserId := sc.ObjectMeta.Annotations[pool.AnnotationControllerId]
+	if releaserId == "" {
+		return "", fmt.Errorf("SC %s is not annotated with %s", storageClass, pool.AnnotationControllerId)
+	}
+	return releaserId, nil
+}
+
+// reportCloneSource warns about a clone source problem, unless the same one was already reported for the pod volume.
+func (p *Provisioner) reportCloneSource(pod *corev1.Pod, volumeName string, problem interface{}) {
+	message := fmt.Sprintf(MessageCloneSource, volumeName, problem)
+	key := fmt.Sprintf("%s/%s", pod.ObjectMeta.UID, volumeName)
+	if reported, ok := p.cloneReports.Get(key); ok && reported == message {
+		return
+	}
+	p.cloneReports.Add(key, message, cloneReportsTTL)
+	p.Recorder.Event(pod, corev1.EventTypeWarning, ErrCloneSource, message)
+}
+
+// clone points the PVC at the latest clone source the Releaser maintains for its Storage Class.
+// PVC is left intact if it already has a data source or there is no clone source yet.
+func (p *Provisioner) clone(pod *corev1.Pod, volumeName string, pvc *corev1.PersistentVolumeClaim) {
+	if pvc.Spec.DataSource != nil || pvc.Spec.DataSourceRef != nil {
+		return
+	}
+	if pvc.Spec.StorageClassName == nil {
+		p.reportCloneSource(pod, volumeName, "storageClassName must be set")
+		return
+	}
+
+	releaserId, err := p.releaserOf(*pvc.Spec.StorageClassName)
+	if err != nil {
+		p.reportCloneSource(pod, volumeName, err)
+		return
+	}
+
+	list, err := p.KubeClientSet.CoreV1().PersistentVolumeClaims(pod.ObjectMeta.Namespace).List(p.Ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			pool.LabelManagedBy:    releaserId,
+			pool.LabelHelper:       pool.HelperClone,
+			pool.LabelStorageClass: *pvc.Spec.StorageClassName,
+		}).String(),
+	})
+	if err != nil {
+		p.reportCloneSource(pod, volumeName, err)
+		return
+	}
+
+	var latest *corev1.PersistentVolumeClaim
+	for i, source := range list.Items {
+		if source.Status.Phase != corev1.ClaimBound || source.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if latest == nil || latest.ObjectMeta.CreationTimestamp.Before(&source.ObjectMeta.CreationTimestamp) {
+			latest = &list.Items[i]
+		}
+	}
+	if latest == nil {
+		klog.V(4).Infof("No clone source for %s/%s volume %s yet", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, volumeName)
+		return
+	}
+
+	pvc.Spec.DataSource = &corev1.TypedLocalObjectReference{
+		Kind: "PersistentVolumeClaim",
+		Name: latest.ObjectMeta.Name,
+	}
+}
@@ -0,0 +1,255 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Volume options
+	AnnotationStorageClassesKey = "storage-classes"
+	AnnotationBindTimeoutKey    = "bind-timeout"
+
+	// Pod annotations, per volume
+	AnnotationUnboundStorageClassesKey = "unbound-storage-classes"
+
+	DefaultBindTimeout = 5 * time.Minute
+
+	// noProvisioner is the provisioner of Storage Classes that can't create PVs on demand
+	noProvisioner = "kubernetes.io/no-provisioner"
+
+	MessageStorageClassFallback = "'%s' PVC %s was not bound in SC %s within %s, falling back to the next Storage Class"
+	StorageClassFallback        = "StorageClassFallback"
+
+	MessageNoStorageClass = "'%s' none of the Storage Classes bound PVC %s: %s"
+	ErrNoStorageClass     = "ErrNoStorageClass"
+)
+
+// WithStorageClassFallback lets volumes list Storage Classes to try in order with the `storage-classes` option.
+func WithStorageClassFallback() Option {
+	return func(p *Provisioner) {
+		p.storageClassFallback = true
+	}
+}
+
+// storageClasses returns the ordered `storage-classes` option of the volume.
+func storageClasses(request *VolumeRequest) []string {
+	storageClasses := []string{}
+	for _, storageClass := range strings.Split(request.Options[AnnotationStorageClassesKey], ",") {
+		if storageClass = strings.TrimSpace(storageClass); storageClass != "" {
+			storageClasses = append(storageClasses, storageClass)
+		}
+	}
+	return storageClasses
+}
+
+func unboundStorageClassesKey(volumeName string) string {
+	return fmt.Sprintf("%s/%s.%s", AnnotationBaseName, volumeName, AnnotationUnboundStorageClassesKey)
+}
+
+// remainingStorageClasses returns Storage Classes of the volume that did not time out for this pod yet.
+func remainingStorageClasses(pod *corev1.Pod, volumeName string, request *VolumeRequest) []string {
+	unbound := map[string]struct{}{}
+	for _, storageClass := range strings.Split(pod.ObjectMeta.Annotations[unboundStorageClassesKey(volumeName)], ",") {
+		unbound[storageClass] = struct{}{}
+	}
+
+	remaining := []string{}
+	for _, storageClass := range storageClasses(request) {
+		if _, ok := unbound[storageClass]; !ok {
+			remaining = append(remaining, storageClass)
+		}
+	}
+	return remaining
+}
+
+func bindTimeout(request *VolumeRequest) (time.Duration, error) {
+	value, ok := request.Options[AnnotationBindTimeoutKey]
+	if !ok {
+		return DefaultBindTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", AnnotationBindTimeoutKey, value)
+	}
+	return timeout, nil
+}
+
+// routePVC sets the PVC Storage Class to the first one of the volume that has an Available PV to bind,
+// or else to the first one that can provision new PVs. Does nothing if the volume does not list Storage Classes.
+func (p *Provisioner) routePVC(pod *corev1.Pod, volumeName string, request *VolumeRequest, pvc *corev1.PersistentVolumeClaim) error {
+	if len(storageClasses(request)) == 0 {
+		return nil
+	}
+	if !p.storageClassFallback {
+		return fmt.Errorf("%s requires Storage Class fallback to be enabled", AnnotationStorageClassesKey)
+	}
+	if _, err := bindTimeout(request); err != nil {
+		return err
+	}
+
+	remaining := remainingStorageClasses(pod, volumeName, request)
+	if len(remaining) == 0 {
+		return fmt.Errorf("all of %s timed out to bind", request.Options[AnnotationStorageClassesKey])
+	}
+
+	pvs, err := p.PVLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	selected := ""
+	for _, storageClass := range remaining {
+		for _, pv := range pvs {
+			if pv.Spec.StorageClassName == storageClass && pvMatches(pv, pvc) {
+				selected = storageClass
+				break
+			}
+		}
+		if selected != "" {
+			break
+		}
+	}
+	if selected == "" {
+		for _, storageClass := range remaining {
+			sc, err := p.SCLister.Get(storageClass)
+			if err != nil {
+				klog.V(5).Infof("Skip SC %s for %s/%s volume %s: %s", storageClass, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, volumeName, err)
+				continue
+			}
+			if sc.Provisioner != noProvisioner {
+				selected = storageClass
+				break
+			}
+		}
+	}
+	if selected == "" {
+		// Nothing to bind to anywhere, wait in the preferred pool until it times out
+		selected = remaining[0]
+	}
+
+	klog.V(4).Infof("Routed %s/%s volume %s to SC %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, volumeName, selected)
+	pvc.Spec.StorageClassName = &selected
+	return nil
+}
+
+// pvMatches returns true if the PV is Available and would satisfy the PVC.
+func pvMatches(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) bool {
+	if pv.Status.Phase != corev1.VolumeAvailable || pv.Spec.ClaimRef != nil || pv.ObjectMeta.DeletionTimestamp != nil {
+		return false
+	}
+	for _, mode := range pvc.Spec.AccessModes {
+		if !hasAccessMode(pv.Spec.AccessModes, mode) {
+			return false
+		}
+	}
+	pvMode, pvcMode := corev1.PersistentVolumeFilesystem, corev1.PersistentVolumeFilesystem
+	if pv.Spec.VolumeMode != nil {
+		pvMode = *pv.Spec.VolumeMode
+	}
+	if pvc.Spec.VolumeMode != nil {
+		pvcMode = *pvc.Spec.VolumeMode
+	}
+	if pvMode != pvcMode {
+		return false
+	}
+	if request, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		capacity, ok := pv.Spec.Capacity[corev1.ResourceStorage]
+		if !ok || capacity.Cmp(request) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rerouteUnbound deletes our PVC that was not bound within the timeout, so it is created again in the next Storage Class.
+// Storage Classes that timed out are remembered on the pod.
+// Only pods that are not scheduled yet are rerouted, the PVC of a scheduled pod can't be deleted while the pod uses it.
+func (p *Provisioner) rerouteUnbound(pod *corev1.Pod, owner metav1.OwnerReference, volumeName string, request *VolumeRequest, claimName string) error {
+	if len(storageClasses(request)) == 0 || !p.storageClassFallback {
+		return nil
+	}
+	if pod.Spec.NodeName != "" {
+		return nil
+	}
+	key := fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+
+	pvc, err := p.PVCLister.PersistentVolumeClaims(pod.ObjectMeta.Namespace).Get(claimName)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !p.ownsPVC(owner.UID, pvc) || pvc.Status.Phase == corev1.ClaimBound {
+		return nil
+	}
+	if pvc.ObjectMeta.DeletionTimestamp != nil {
+		// Not necessarily owned by the pod, so PVC deletion might not queue it
+		p.PodsQueue.AddAfter(key, time.Second*5)
+		return nil
+	}
+
+	timeout, err := bindTimeout(request)
+	if err != nil {
+		p.Recorder.Event(pod, corev1.EventTypeWarning, ErrInvalidPVC, fmt.Sprintf(MessageInvalidPVC, volumeName, err))
+		return nil
+	}
+	if remaining := time.Until(pvc.ObjectMeta.CreationTimestamp.Add(timeout)); remaining > 0 {
+		p.PodsQueue.AddAfter(key, remaining)
+		return nil
+	}
+
+	storageClass := ""
+	if pvc.Spec.StorageClassName != nil {
+		storageClass = *pvc.Spec.StorageClassName
+	}
+	next := []string{}
+	for _, remaining := range remainingStorageClasses(pod, volumeName, request) {
+		if remaining != storageClass {
+			next = append(next, remaining)
+		}
+	}
+	if len(next) == 0 {
+		p.Recorder.Event(pod, corev1.EventTypeWarning, ErrNoStorageClass, fmt.Sprintf(MessageNoStorageClass, volumeName, claimName,
+			fmt.Sprintf("SC %s is the last one, keep waiting", storageClass)))
+		return nil
+	}
+
+	unbound := pod.ObjectMeta.Annotations[unboundStorageClassesKey(volumeName)]
+	if unbound != "" {
+		unbound += ","
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				unboundStorageClassesKey(volumeName): unbound + storageClass,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = p.KubeClientSet.CoreV1().Pods(pod.ObjectMeta.Namespace).Patch(p.Ctx, pod.ObjectMeta.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+
+	err = p.KubeClientSet.CoreV1().PersistentVolumeClaims(pod.ObjectMeta.Namespace).Delete(p.Ctx, claimName, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &pvc.ObjectMeta.UID},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		return err
+	}
+	p.Recorder.Event(pod, corev1.EventTypeNormal, StorageClassFallback, fmt.Sprintf(MessageStorageClassFallback, volumeName, claimName, storageClass, timeout))
+	return nil
+}
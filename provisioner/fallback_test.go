@@ -0,0 +1,376 @@
+package provisioner
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func fallbackTestPV(name, storageClass, size string, modes ...corev1.PersistentVolumeAccessMode) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			StorageClassName: storageClass,
+			AccessModes:      modes,
+			Capacity:         corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+		},
+		Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeAvailable},
+	}
+}
+
+func fallbackTestPVC(size string, modes ...corev1.PersistentVolumeAccessMode) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: modes,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func fallbackTestPod(unbound string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "build", Namespace: "default", UID: "pod-uid"}}
+	if unbound != "" {
+		pod.ObjectMeta.Annotations = map[string]string{unboundStorageClassesKey("cache"): unbound}
+	}
+	return pod
+}
+
+func fallbackTestRequest(storageClasses string) *VolumeRequest {
+	return &VolumeRequest{Volume: "cache", Options: map[string]string{AnnotationStorageClassesKey: storageClasses}}
+}
+
+func TestPVMatches(t *testing.T) {
+	block := corev1.PersistentVolumeBlock
+	rwo := corev1.ReadWriteOnce
+	rwx := corev1.ReadWriteMany
+
+	tests := []struct {
+		name   string
+		modify func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim)
+		want   bool
+	}{
+		{
+			name: "matches",
+			want: true,
+		},
+		{
+			name: "not available",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				pv.Status.Phase = corev1.VolumeReleased
+			},
+		},
+		{
+			name: "pre-bound",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "default", Name: "other"}
+			},
+		},
+		{
+			name: "being deleted",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				now := metav1.Now()
+				pv.ObjectMeta.DeletionTimestamp = &now
+			},
+		},
+		{
+			name: "missing access mode",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				pv.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{rwo}
+				pvc.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{rwx}
+			},
+		},
+		{
+			name: "volume mode differs",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				pvc.Spec.VolumeMode = &block
+			},
+		},
+		{
+			name: "same volume mode",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				pv.Spec.VolumeMode = &block
+				pvc.Spec.VolumeMode = &block
+			},
+			want: true,
+		},
+		{
+			name: "too small",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				pvc.Spec.Resources.Requests[corev1.ResourceStorage] = resource.MustParse("20Gi")
+			},
+		},
+		{
+			name: "no size requested",
+			modify: func(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				delete(pvc.Spec.Resources.Requests, corev1.ResourceStorage)
+			},
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pv := fallbackTestPV("pv", "pool", "10Gi", rwo, rwx)
+			pvc := fallbackTestPVC("10Gi", rwo)
+			if test.modify != nil {
+				test.modify(pv, pvc)
+			}
+			if got := pvMatches(pv, pvc); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRemainingStorageClasses(t *testing.T) {
+	tests := []struct {
+		name           string
+		storageClasses string
+		unbound        string
+		want           []string
+	}{
+		{
+			name: "none listed",
+			want: []string{},
+		},
+		{
+			name:           "none timed out",
+			storageClasses: "zone-a, zone-b,,shared",
+			want:           []string{"zone-a", "zone-b", "shared"},
+		},
+		{
+			name:           "some timed out",
+			storageClasses: "zone-a,zone-b,shared",
+			unbound:        "zone-a,shared",
+			want:           []string{"zone-b"},
+		},
+		{
+			name:           "all timed out",
+			storageClasses: "zone-a,shared",
+			unbound:        "shared,zone-a",
+			want:           []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := remainingStorageClasses(fallbackTestPod(test.unbound), "cache", fallbackTestRequest(test.storageClasses))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRoutePVC(t *testing.T) {
+	rwo := corev1.ReadWriteOnce
+
+	pvs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pv := range []*corev1.PersistentVolume{
+		fallbackTestPV("small-in-zone-a", "zone-a", "1Gi", rwo),
+		fallbackTestPV("fits-in-zone-b", "zone-b", "10Gi", rwo),
+		fallbackTestPV("fits-in-static", "static", "10Gi", rwo),
+	} {
+		_ = pvs.Add(pv)
+	}
+	scs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, sc := range []*storagev1.StorageClass{
+		{ObjectMeta: metav1.ObjectMeta{Name: "zone-a"}, Provisioner: noProvisioner},
+		{ObjectMeta: metav1.ObjectMeta{Name: "zone-b"}, Provisioner: noProvisioner},
+		{ObjectMeta: metav1.ObjectMeta{Name: "static"}, Provisioner: noProvisioner},
+		{ObjectMeta: metav1.ObjectMeta{Name: "shared"}, Provisioner: "efs.csi.aws.com"},
+	} {
+		_ = scs.Add(sc)
+	}
+
+	p := &Provisioner{
+		PVLister:             corelisters.NewPersistentVolumeLister(pvs),
+		SCLister:             storagelisters.NewStorageClassLister(scs),
+		storageClassFallback: true,
+	}
+
+	tests := []struct {
+		name           string
+		storageClasses string
+		unbound        string
+		options        map[string]string
+		fallback       bool
+		want           string
+		wantErr        bool
+	}{
+		{
+			name: "not listed",
+			want: "standard",
+		},
+		{
+			name:           "first with a matching PV",
+			storageClasses: "zone-a,zone-b,static",
+			want:           "zone-b",
+		},
+		{
+			name:           "skips timed out",
+			storageClasses: "zone-a,zone-b,static",
+			unbound:        "zone-b",
+			want:           "static",
+		},
+		{
+			name:           "first that can provision",
+			storageClasses: "zone-a,missing,shared",
+			want:           "shared",
+		},
+		{
+			name:           "first listed if nothing fits",
+			storageClasses: "zone-a,missing",
+			want:           "zone-a",
+		},
+		{
+			name:           "all timed out",
+			storageClasses: "zone-a,shared",
+			unbound:        "zone-a,shared",
+			wantErr:        true,
+		},
+		{
+			name:           "invalid bind timeout",
+			storageClasses: "zone-a",
+			options:        map[string]string{AnnotationBindTimeoutKey: "soon"},
+			wantErr:        true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := fallbackTestRequest(test.storageClasses)
+			for key, value := range test.options {
+				request.Options[key] = value
+			}
+			pvc := fallbackTestPVC("10Gi", rwo)
+			standard := "standard"
+			pvc.Spec.StorageClassName = &standard
+
+			err := p.routePVC(fallbackTestPod(test.unbound), "cache", request, pvc)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := *pvc.Spec.StorageClassName; got != test.want {
+				t.Errorf("expected SC %s, got %s", test.want, got)
+			}
+		})
+	}
+
+	disabled := &Provisioner{}
+	if err := disabled.routePVC(fallbackTestPod(""), "cache", fallbackTestRequest("zone-a"), fallbackTestPVC("1Gi")); err == nil {
+		t.Error("expected an error with Storage Class fallback disabled")
+	}
+}
+
+func TestRerouteUnbound(t *testing.T) {
+	pod := fallbackTestPod("")
+	owner := *metav1.NewControllerRef(pod, corev1.SchemeGroupVersion.WithKind("Pod"))
+	zoneA := "zone-a"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "cache",
+			Namespace:         "default",
+			UID:               "pvc-uid",
+			OwnerReferences:   []metav1.OwnerReference{owner},
+			Labels:            map[string]string{LabelManagedBy: "ci"},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+		},
+		Spec:   corev1.PersistentVolumeClaimSpec{StorageClassName: &zoneA},
+		Status: corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+	}
+
+	tests := []struct {
+		name        string
+		nodeName    string
+		options     map[string]string
+		wantDeleted bool
+		wantEvent   string
+	}{
+		{
+			name:        "timed out",
+			wantDeleted: true,
+			wantEvent:   StorageClassFallback,
+		},
+		{
+			name:     "scheduled",
+			nodeName: "node-1",
+		},
+		{
+			name:      "invalid bind timeout",
+			options:   map[string]string{AnnotationBindTimeoutKey: "soon"},
+			wantEvent: ErrInvalidPVC,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testPod := pod.DeepCopy()
+			testPod.Spec.NodeName = test.nodeName
+			client := fake.NewSimpleClientset(testPod, pvc.DeepCopy())
+			pvcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			_ = pvcs.Add(pvc)
+			recorder := record.NewFakeRecorder(10)
+			p := &Provisioner{
+				BasicController: controller.BasicController{
+					Ctx:           context.Background(),
+					KubeClientSet: client,
+					Recorder:      recorder,
+					ControllerId:  "ci",
+				},
+				PVCLister:            corelisters.NewPersistentVolumeClaimLister(pvcs),
+				PodsQueue:            workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+				storageClassFallback: true,
+			}
+			defer p.PodsQueue.ShutDown()
+
+			request := fallbackTestRequest("zone-a,shared")
+			request.Options[AnnotationBindTimeoutKey] = "1m"
+			for key, value := range test.options {
+				request.Options[key] = value
+			}
+			if err := p.rerouteUnbound(testPod, owner, "cache", request, "cache"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			_, err := client.CoreV1().PersistentVolumeClaims("default").Get(context.Background(), "cache", metav1.GetOptions{})
+			if deleted := err != nil; deleted != test.wantDeleted {
+				t.Errorf("expected PVC deleted %v, got %v", test.wantDeleted, deleted)
+			}
+			select {
+			case event := <-recorder.Events:
+				if test.wantEvent == "" {
+					t.Errorf("expected no event, got %s", event)
+				} else if reason := strings.SplitN(event, " ", 3)[1]; reason != test.wantEvent {
+					t.Errorf("expected %s event, got %s", test.wantEvent, event)
+				}
+			default:
+				if test.wantEvent != "" {
+					t.Errorf("expected %s event", test.wantEvent)
+				}
+			}
+		})
+	}
+}
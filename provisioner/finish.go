@@ -0,0 +1,91 @@
+package provisioner
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Volume options
+	AnnotationReleaseOnFinishKey = "release-on-finish"
+
+	PVCReleased        = "PVCReleased"
+	MessagePVCReleased = "'%s' PVC %s deleted as the pod finished"
+)
+
+// podFinishedAt returns when the last container of the pod terminated.
+func podFinishedAt(pod *corev1.Pod) time.Time {
+	var finishedAt time.Time
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if terminated := status.State.Terminated; terminated != nil && terminated.FinishedAt.Time.After(finishedAt) {
+			finishedAt = terminated.FinishedAt.Time
+		}
+	}
+	return finishedAt
+}
+
+// releaseOnFinish deletes PVCs of a Succeeded or Failed pod after a per-volume grace period,
+// so PVs get back to the pool without waiting for the pod to be deleted.
+func (p *Provisioner) releaseOnFinish(pod *corev1.Pod) error {
+	requests, _ := parseVolumeRequests(pod)
+	key := fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+	finishedAt := podFinishedAt(pod)
+
+	for _, volume := range pod.Spec.Volumes {
+		request, ok := requests[volume.Name]
+		if !ok || volume.VolumeSource.PersistentVolumeClaim == nil {
+			continue
+		}
+		value, ok := request.Options[AnnotationReleaseOnFinishKey]
+		if !ok {
+			continue
+		}
+		grace, err := time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			p.Recorder.Event(
+				pod,
+				corev1.EventTypeWarning,
+				ErrInvalidPVC,
+				fmt.Sprintf(MessageInvalidPVC, volume.Name, fmt.Sprintf("invalid %s %q", AnnotationReleaseOnFinishKey, value)),
+			)
+			continue
+		}
+		if remaining := time.Until(finishedAt.Add(grace)); remaining > 0 {
+			klog.V(4).Infof("PVC of pod %s volume %s will be released in %s", key, volume.Name, remaining)
+			p.PodsQueue.AddAfter(key, remaining)
+			continue
+		}
+
+		claimName := volume.VolumeSource.PersistentVolumeClaim.ClaimName
+		pvc, err := p.PVCLister.PersistentVolumeClaims(pod.ObjectMeta.Namespace).Get(claimName)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if pvc.ObjectMeta.DeletionTimestamp != nil || !p.ownsPVC(pod.ObjectMeta.UID, pvc) {
+			continue
+		}
+
+		err = p.KubeClientSet.CoreV1().PersistentVolumeClaims(pod.ObjectMeta.Namespace).Delete(p.Ctx, claimName, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &pvc.ObjectMeta.UID},
+		})
+		if errors.IsNotFound(err) || errors.IsConflict(err) {
+			// Already gone or replaced with another PVC, nothing was released
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p.Recorder.Event(pod, corev1.EventTypeNormal, PVCReleased, fmt.Sprintf(MessagePVCReleased, volume.Name, claimName))
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+// Scheduling gate keeps pods out of the scheduler until their PVCs are ready.
+// The webhook adds it on pod creation, Provisioner removes it.
+const (
+	SchedulingGate = AnnotationBaseName + "/volumes"
+
+	GateRecheckInterval = 5 * time.Second
+
+	PodUngated        = "PodUngated"
+	MessagePodUngated = "Requested PVCs are ready, removed scheduling gate %s"
+)
+
+// WebhookConfig configures the mutating webhook that gates pods and sets claim names of controller owned volumes.
+type WebhookConfig struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+
+	// PodSelector must match the one Provisioner uses, or else ignored pods would be gated forever
+	PodSelector labels.Selector
+
+	// DynamicClient, RESTMapper and OwnerPassThroughKinds must match the ones Provisioner uses,
+	// so that the claim is named after the same owner Provisioner sets on the PVC
+	DynamicClient         dynamic.Interface
+	RESTMapper            meta.RESTMapper
+	OwnerPassThroughKinds []string
+}
+
+// WithUngateOnBound keeps the scheduling gate until requested PVCs are Bound, not only created.
+func WithUngateOnBound(ungateOnBound bool) Option {
+	return func(p *Provisioner) {
+		p.UngateOnBound = ungateOnBound
+	}
+}
+
+func hasGate(pod *corev1.Pod) bool {
+	for _, gate := range pod.Spec.SchedulingGates {
+		if gate.Name == SchedulingGate {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonPatch struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// mutatePod returns JSON patch operations for a pod that requests volumes, nil if the pod is not ours.
+func mutatePod(ctx context.Context, pod *corev1.Pod, selector labels.Selector, owners *ownerResolver) []jsonPatch {
+	requests, _ := parseVolumeRequests(pod)
+	if len(requests) == 0 {
+		return nil
+	}
+	if selector != nil && !selector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+		return nil
+	}
+
+	patches, err := claimPatches(ctx, pod, requests, owners)
+	if err != nil {
+		// The pod keeps the claim name from its template
+		klog.Warningf("Failed to resolve PVC owner of pod %s/%s%s: %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.ObjectMeta.GenerateName, err)
+	}
+	if !hasGate(pod) {
+		patches = append(patches, gatePatch(pod))
+	}
+	return patches
+}
+
+// gatePatch returns a JSON patch operation adding the scheduling gate.
+func gatePatch(pod *corev1.Pod) jsonPatch {
+	gate := corev1.PodSchedulingGate{Name: SchedulingGate}
+	if len(pod.Spec.SchedulingGates) == 0 {
+		return jsonPatch{Op: "add", Path: "/spec/schedulingGates", Value: []corev1.PodSchedulingGate{gate}}
+	}
+	return jsonPatch{Op: "add", Path: "/spec/schedulingGates/-", Value: gate}
+}
+
+// ownerClaimName derives the claim name of a controller owned volume, so that controllers created from the same template,
+// i.e. Jobs of a CronJob, don't share one.
+func ownerClaimName(owner metav1.OwnerReference, volumeName string) string {
+	name := strings.ToLower(fmt.Sprintf("%s-%s-%s", owner.Kind, owner.Name, volumeName))
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength-len(hash)-1], "-.") + "-" + hash
+}
+
+// claimPatches returns JSON patch operations pointing `owner: controller` volumes at the claim name derived from the pod controller.
+func claimPatches(ctx context.Context, pod *corev1.Pod, requests map[string]*VolumeRequest, owners *ownerResolver) ([]jsonPatch, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return nil, nil
+	}
+
+	patches := []jsonPatch{}
+	var owner *metav1.OwnerReference
+	for i, volume := range pod.Spec.Volumes {
+		request, ok := requests[volume.Name]
+		if !ok || volume.VolumeSource.PersistentVolumeClaim == nil {
+			continue
+		}
+		if byController, err := ownsByController(request); err != nil || !byController {
+			continue
+		}
+		if owner == nil {
+			resolved, err := owners.resolve(ctx, pod.ObjectMeta.Namespace, ref)
+			if err != nil {
+				return nil, err
+			}
+			owner = &resolved
+		}
+		claimName := ownerClaimName(*owner, volume.Name)
+		if volume.VolumeSource.PersistentVolumeClaim.ClaimName == claimName {
+			continue
+		}
+		patches = append(patches, jsonPatch{
+			Op:    "replace",
+			Path:  fmt.Sprintf("/spec/volumes/%d/persistentVolumeClaim/claimName", i),
+			Value: claimName,
+		})
+	}
+	return patches, nil
+}
+
+// ServeWebhook serves the pod mutating webhook over TLS until stopCh is closed.
+// It runs on every replica, as the API server may call any of them.
+func ServeWebhook(config *WebhookConfig, stopCh <-chan struct{}) error {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("webhook requires a TLS certificate and key")
+	}
+
+	owners := newOwnerResolver(config.DynamicClient, config.RESTMapper, config.OwnerPassThroughKinds)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /mutate-pods", func(w http.ResponseWriter, req *http.Request) {
+		handleMutatePod(w, req, config.PodSelector, owners)
+	})
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Warningf("Failed to shut down webhook: %s", err)
+		}
+	}()
+
+	klog.Infof("Serving webhook on %s", config.Addr)
+	if err := server.ListenAndServeTLS(config.CertFile, config.KeyFile); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// handleMutatePod never denies a pod, at worst it is left without the gate.
+func handleMutatePod(w http.ResponseWriter, req *http.Request, selector labels.Selector, owners *ownerResolver) {
+	review := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(review.Request.Object.Raw, pod); err != nil {
+		klog.Warningf("Failed to decode pod %s/%s: %s", review.Request.Namespace, review.Request.Name, err)
+	} else {
+		// Namespace is not set yet on pods created without one
+		if pod.ObjectMeta.Namespace == "" {
+			pod.ObjectMeta.Namespace = review.Request.Namespace
+		}
+		if patches := mutatePod(req.Context(), pod, selector, owners); len(patches) > 0 {
+			if patch, err := json.Marshal(patches); err != nil {
+				klog.Warningf("Failed to patch pod %s/%s: %s", review.Request.Namespace, review.Request.Name, err)
+			} else {
+				patchType := admissionv1.PatchTypeJSONPatch
+				response.Patch = patch
+				response.PatchType = &patchType
+				klog.V(4).Infof("Patched pod %s/%s%s: %s", review.Request.Namespace, pod.ObjectMeta.Name, pod.ObjectMeta.GenerateName, patch)
+			}
+		}
+	}
+
+	review.Request = nil
+	review.Response = response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		klog.Errorf("Failed to write AdmissionReview: %s", err)
+	}
+}
+
+// ungate removes the scheduling gate once every requested PVC exists, or is Bound with WithUngateOnBound.
+// Only PVCs created in this sync are rechecked while missing from the cache, the others failed and were reported,
+// or are waiting on a checkout or policy that requeues the pod by itself.
+func (p *Provisioner) ungate(pod *corev1.Pod, requests map[string]*VolumeRequest, created map[string]bool) error {
+	if !hasGate(pod) {
+		return nil
+	}
+	key := fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+
+	for volumeName, request := range requests {
+		if request.claimName == "" {
+			// Can't be satisfied, the problem is already reported
+			return nil
+		}
+		pvc, err := p.PVCLister.PersistentVolumeClaims(pod.ObjectMeta.Namespace).Get(request.claimName)
+		if errors.IsNotFound(err) {
+			klog.V(5).Infof("Pod %s volume %s PVC %s does not exist yet, keep the gate", key, volumeName, request.claimName)
+			if created[volumeName] {
+				p.PodsQueue.AddAfter(key, GateRecheckInterval)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.UngateOnBound && pvc.Status.Phase != corev1.ClaimBound {
+			klog.V(5).Infof("Pod %s volume %s PVC %s is not Bound yet, keep the gate", key, volumeName, request.claimName)
+			p.PodsQueue.AddAfter(key, GateRecheckInterval)
+			return nil
+		}
+	}
+
+	podCopy := pod.DeepCopy()
+	gates := []corev1.PodSchedulingGate{}
+	for _, gate := range podCopy.Spec.SchedulingGates {
+		if gate.Name != SchedulingGate {
+			gates = append(gates, gate)
+		}
+	}
+	podCopy.Spec.SchedulingGates = gates
+	_, err := p.KubeClientSet.CoreV1().Pods(pod.ObjectMeta.Namespace).Update(p.Ctx, podCopy, metav1.UpdateOptions{})
+	if err != nil {
+		if errors.IsConflict(err) {
+			klog.V(4).Infof("Pod %s had a conflict - ignore it, it will be queued again with a new version", key)
+			return nil
+		}
+		return err
+	}
+	p.Recorder.Event(pod, corev1.EventTypeNormal, PodUngated, fmt.Sprintf(MessagePodUngated, SchedulingGate))
+	return nil
+}
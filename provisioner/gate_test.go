@@ -0,0 +1,146 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func gateTestPod(podLabels map[string]string, gates ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+			Labels:    podLabels,
+			Annotations: map[string]string{
+				AnnotationVolumes: "- volume: cache\n  template: maven-cache\n",
+			},
+		},
+	}
+	for _, gate := range gates {
+		pod.Spec.SchedulingGates = append(pod.Spec.SchedulingGates, corev1.PodSchedulingGate{Name: gate})
+	}
+	return pod
+}
+
+// ownedTestPod is a Job pod with an `owner: controller` volume and a volume owned by the pod.
+func ownedTestPod(claimName string) *corev1.Pod {
+	pod := gateTestPod(nil, SchedulingGate)
+	pod.ObjectMeta.Annotations[AnnotationVolumes] = `
+- volume: scratch
+  template: scratch
+- volume: cache
+  template: maven-cache
+  options:
+    owner: controller
+`
+	pod.ObjectMeta.OwnerReferences = []metav1.OwnerReference{*controllerRef("batch/v1", "Job", "nightly-123", "job-uid")}
+	pod.Spec.Volumes = []corev1.Volume{
+		{Name: "scratch", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "scratch"}}},
+		{Name: "cache", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}}},
+	}
+	return pod
+}
+
+func TestMutatePod(t *testing.T) {
+	selector := labels.SelectorFromSet(labels.Set{"app": "build"})
+	gate := map[string]interface{}{"name": SchedulingGate}
+
+	tests := []struct {
+		name     string
+		pod      *corev1.Pod
+		selector labels.Selector
+		want     []jsonPatch
+	}{
+		{
+			name: "no requested volumes",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}},
+		},
+		{
+			name: "no gates yet",
+			pod:  gateTestPod(nil),
+			want: []jsonPatch{{Op: "add", Path: "/spec/schedulingGates", Value: []interface{}{gate}}},
+		},
+		{
+			name: "other gates",
+			pod:  gateTestPod(nil, "example.com/other"),
+			want: []jsonPatch{{Op: "add", Path: "/spec/schedulingGates/-", Value: gate}},
+		},
+		{
+			name: "already gated",
+			pod:  gateTestPod(nil, SchedulingGate),
+		},
+		{
+			name:     "selector matches",
+			pod:      gateTestPod(map[string]string{"app": "build"}),
+			selector: selector,
+			want:     []jsonPatch{{Op: "add", Path: "/spec/schedulingGates", Value: []interface{}{gate}}},
+		},
+		{
+			name:     "selector does not match",
+			pod:      gateTestPod(map[string]string{"app": "web"}),
+			selector: selector,
+		},
+		{
+			name: "claim name derived from controller",
+			pod:  ownedTestPod("cache"),
+			want: []jsonPatch{{Op: "replace", Path: "/spec/volumes/1/persistentVolumeClaim/claimName", Value: "job-nightly-123-cache"}},
+		},
+		{
+			name: "claim name already derived",
+			pod:  ownedTestPod("job-nightly-123-cache"),
+		},
+	}
+
+	owners := newOwnerResolver(nil, nil, nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patches := mutatePod(context.Background(), test.pod, test.selector, owners)
+			if test.want == nil {
+				if len(patches) != 0 {
+					t.Fatalf("expected no patch, got %v", patches)
+				}
+				return
+			}
+
+			patch, err := json.Marshal(patches)
+			if err != nil {
+				t.Fatalf("invalid patch %v: %s", patches, err)
+			}
+			got := []jsonPatch{}
+			if err := json.Unmarshal(patch, &got); err != nil {
+				t.Fatalf("invalid patch %s: %s", patch, err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(test.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("expected patch %s, got %s", wantJSON, gotJSON)
+			}
+		})
+	}
+}
+
+func TestOwnerClaimName(t *testing.T) {
+	job := *controllerRef("batch/v1", "Job", "nightly-123", "job-uid")
+	if got, want := ownerClaimName(job, "cache"), "job-nightly-123-cache"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	long := *controllerRef("batch/v1", "Job", strings.Repeat("a", validation.DNS1123SubdomainMaxLength), "job-uid")
+	name := ownerClaimName(long, "cache")
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		t.Errorf("expected at most %d characters, got %d", validation.DNS1123SubdomainMaxLength, len(name))
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		t.Errorf("expected a valid name, got %q: %v", name, errs)
+	}
+	if other := ownerClaimName(long, "build"); other == name {
+		t.Errorf("expected long names of different volumes to differ, both are %q", name)
+	}
+}
@@ -0,0 +1,62 @@
+package provisioner
+
+import (
+	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// emptyIndexer backs listers of namespaces that are not watched.
+var emptyIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+// podLister lists pods across all namespaces watched by NamespaceInformers.
+type podLister struct {
+	informers *controller.NamespaceInformers
+}
+
+func (l *podLister) List(selector labels.Selector) ([]*corev1.Pod, error) {
+	pods := []*corev1.Pod{}
+	for _, namespace := range l.informers.Namespaces() {
+		list, err := l.Pods(namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, list...)
+	}
+	return pods, nil
+}
+
+func (l *podLister) Pods(namespace string) corelisters.PodNamespaceLister {
+	factory := l.informers.Factory(namespace)
+	if factory == nil {
+		return corelisters.NewPodLister(emptyIndexer).Pods(namespace)
+	}
+	return factory.Core().V1().Pods().Lister().Pods(namespace)
+}
+
+// pvcLister lists PVCs across all namespaces watched by NamespaceInformers.
+type pvcLister struct {
+	informers *controller.NamespaceInformers
+}
+
+func (l *pvcLister) List(selector labels.Selector) ([]*corev1.PersistentVolumeClaim, error) {
+	pvcs := []*corev1.PersistentVolumeClaim{}
+	for _, namespace := range l.informers.Namespaces() {
+		list, err := l.PersistentVolumeClaims(namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		pvcs = append(pvcs, list...)
+	}
+	return pvcs, nil
+}
+
+func (l *pvcLister) PersistentVolumeClaims(namespace string) corelisters.PersistentVolumeClaimNamespaceLister {
+	factory := l.informers.Factory(namespace)
+	if factory == nil {
+		return corelisters.NewPersistentVolumeClaimLister(emptyIndexer).PersistentVolumeClaims(namespace)
+	}
+	return factory.Core().V1().PersistentVolumeClaims().Lister().PersistentVolumeClaims(namespace)
+}
@@ -0,0 +1,198 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Volume options
+	AnnotationOwnerKey = "owner"
+
+	OwnerPod        = "pod"
+	OwnerController = "controller"
+
+	// maxOwnerDepth guards against owner reference cycles
+	maxOwnerDepth = 10
+
+	// Resolved owners are cached by the UID of the pod controller. A ReplicaSet can be adopted or orphaned
+	// by a Deployment, so the cache is kept short and a stale owner is only used by PVCs created within it.
+	ownerCacheSize = 1024
+	ownerCacheTTL  = time.Minute
+
+	MessagePVCOwner = "'%s' failed to resolve PVC owner: %s"
+	ErrPVCOwner     = "ErrPVCOwner"
+)
+
+// DefaultOwnerPassThroughKinds are controllers that only exist as an implementation detail of their own controller.
+var DefaultOwnerPassThroughKinds = []string{"ReplicaSet"}
+
+// WithRESTMapper sets a mapper to resolve owner references of arbitrary kinds.
+// Required by the `owner: controller` volume option along with WithDynamicClient.
+func WithRESTMapper(mapper meta.RESTMapper) Option {
+	return func(p *Provisioner) {
+		p.RESTMapper = mapper
+	}
+}
+
+// WithOwnerPassThroughKinds sets controller kinds that are skipped in favor of their own controller
+// when resolving `owner: controller`, defaults to DefaultOwnerPassThroughKinds.
+func WithOwnerPassThroughKinds(kinds []string) Option {
+	return func(p *Provisioner) {
+		p.OwnerPassThroughKinds = kinds
+	}
+}
+
+// ownerResolver finds the controller that owns PVCs of `owner: controller` volumes.
+type ownerResolver struct {
+	client      dynamic.Interface
+	mapper      meta.RESTMapper
+	passThrough map[string]bool
+	cache       *utilcache.LRUExpireCache
+}
+
+func newOwnerResolver(client dynamic.Interface, mapper meta.RESTMapper, passThroughKinds []string) *ownerResolver {
+	if passThroughKinds == nil {
+		passThroughKinds = DefaultOwnerPassThroughKinds
+	}
+	passThrough := make(map[string]bool, len(passThroughKinds))
+	for _, kind := range passThroughKinds {
+		passThrough[kind] = true
+	}
+	return &ownerResolver{
+		client:      client,
+		mapper:      mapper,
+		passThrough: passThrough,
+		cache:       utilcache.NewLRUExpireCache(ownerCacheSize),
+	}
+}
+
+// ownsByController returns true if the volume asks for its PVC to be owned by the pod controller.
+func ownsByController(request *VolumeRequest) (bool, error) {
+	switch owner := request.Options[AnnotationOwnerKey]; owner {
+	case "", OwnerPod:
+		return false, nil
+	case OwnerController:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown %s %q", AnnotationOwnerKey, owner)
+	}
+}
+
+// pvcOwner returns the controller reference to set on the PVC.
+// By default that is the pod itself, with `owner: controller` it is the controller of the pod,
+// so that retries of the same Job, Workflow etc. share the PVC and it is only deleted with that controller.
+// Pods of a controller are created from the same template, so they all reference the same claim name.
+// A pod without a controller owns its PVC either way.
+func (p *Provisioner) pvcOwner(pod *corev1.Pod, request *VolumeRequest) (metav1.OwnerReference, error) {
+	podRef := *metav1.NewControllerRef(pod, corev1.SchemeGroupVersion.WithKind("Pod"))
+
+	byController, err := ownsByController(request)
+	if err != nil {
+		return metav1.OwnerReference{}, err
+	}
+	if !byController {
+		return podRef, nil
+	}
+
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		klog.V(5).Infof("Pod %s/%s has no controller, it owns its PVC", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+		return podRef, nil
+	}
+
+	owner, err := p.owners.resolve(p.Ctx, pod.ObjectMeta.Namespace, ref)
+	if err != nil {
+		return metav1.OwnerReference{}, err
+	}
+	klog.V(4).Infof("Resolved PVC owner of pod %s/%s to %s %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, owner.Kind, owner.Name)
+	return owner, nil
+}
+
+// resolve follows the controller reference of a pod through pass-through kinds, i.e. Pod -> ReplicaSet -> Deployment,
+// and stops at the first other kind, so a Job owned by a CronJob owns the PVC rather than the CronJob.
+func (r *ownerResolver) resolve(ctx context.Context, namespace string, ref *metav1.OwnerReference) (metav1.OwnerReference, error) {
+	if cached, ok := r.cache.Get(ref.UID); ok {
+		return cached.(metav1.OwnerReference), nil
+	}
+
+	owner := ref
+	for depth := 0; r.passThrough[owner.Kind]; depth++ {
+		if depth >= maxOwnerDepth {
+			return metav1.OwnerReference{}, fmt.Errorf("owner chain is longer than %d", maxOwnerDepth)
+		}
+		next, err := r.controllerOf(ctx, namespace, owner)
+		if err != nil {
+			return metav1.OwnerReference{}, err
+		}
+		if next == nil {
+			break
+		}
+		owner = next
+	}
+
+	controller := true
+	// BlockOwnerDeletion is left unset as it requires permissions to update finalizers of an arbitrary kind
+	resolved := metav1.OwnerReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		UID:        owner.UID,
+		Controller: &controller,
+	}
+	r.cache.Add(ref.UID, resolved, ownerCacheTTL)
+	return resolved, nil
+}
+
+// controllerOf looks up the object behind the reference and returns its own controller reference, if any.
+func (r *ownerResolver) controllerOf(ctx context.Context, namespace string, ref *metav1.OwnerReference) (*metav1.OwnerReference, error) {
+	if r.client == nil || r.mapper == nil {
+		return nil, fmt.Errorf("owner resolution requires a dynamic client and a REST mapper")
+	}
+
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	gk := schema.GroupKind{Group: gv.Group, Kind: ref.Kind}
+	mapping, err := r.mapper.RESTMapping(gk, gv.Version)
+	if meta.IsNoMatchError(err) {
+		// The kind may have been installed after discovery was cached
+		if resettable, ok := r.mapper.(meta.ResettableRESTMapper); ok {
+			resettable.Reset()
+			mapping, err = r.mapper.RESTMapping(gk, gv.Version)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resource := r.client.Resource(mapping.Resource)
+	var obj metav1.Object
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		obj, err = resource.Namespace(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	} else {
+		obj, err = resource.Get(ctx, ref.Name, metav1.GetOptions{})
+	}
+	if errors.IsNotFound(err) {
+		return nil, fmt.Errorf("%s %s no longer exists", ref.Kind, ref.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if obj.GetUID() != ref.UID {
+		return nil, fmt.Errorf("%s %s was replaced", ref.Kind, ref.Name)
+	}
+
+	return metav1.GetControllerOf(obj), nil
+}
@@ -0,0 +1,149 @@
+package provisioner
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var replicaSetResource = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+
+func controllerRef(apiVersion, kind, name string, uid types.UID) *metav1.OwnerReference {
+	isController := true
+	return &metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, UID: uid, Controller: &isController}
+}
+
+func replicaSet(name string, uid types.UID, owner *metav1.OwnerReference) *unstructured.Unstructured {
+	rs := &unstructured.Unstructured{}
+	rs.SetAPIVersion("apps/v1")
+	rs.SetKind("ReplicaSet")
+	rs.SetNamespace("default")
+	rs.SetName(name)
+	rs.SetUID(uid)
+	if owner != nil {
+		rs.SetOwnerReferences([]metav1.OwnerReference{*owner})
+	}
+	return rs
+}
+
+// newTestOwnerResolver serves ReplicaSets from a fake dynamic client.
+func newTestOwnerResolver(objects ...runtime.Object) (*ownerResolver, *dynamicfake.FakeDynamicClient) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}, meta.RESTScopeNamespace)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{replicaSetResource: "ReplicaSetList"},
+		objects...,
+	)
+	return newOwnerResolver(client, mapper, nil), client
+}
+
+func TestOwnerResolverStopsAtFirstController(t *testing.T) {
+	// No client, nothing must be looked up
+	owners := newOwnerResolver(nil, nil, nil)
+	job := controllerRef("batch/v1", "Job", "nightly-123", "job-uid")
+
+	owner, err := owners.resolve(context.Background(), "default", job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if owner.Kind != "Job" || owner.Name != "nightly-123" || owner.UID != "job-uid" {
+		t.Errorf("expected Job nightly-123, got %s %s", owner.Kind, owner.Name)
+	}
+	if owner.Controller == nil || !*owner.Controller {
+		t.Error("expected a controller reference")
+	}
+}
+
+func TestOwnerResolverPassThrough(t *testing.T) {
+	deployment := controllerRef("apps/v1", "Deployment", "web", "deployment-uid")
+	owners, client := newTestOwnerResolver(replicaSet("web-abc", "rs-uid", deployment))
+
+	owner, err := owners.resolve(context.Background(), "default", controllerRef("apps/v1", "ReplicaSet", "web-abc", "rs-uid"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if owner.Kind != "Deployment" || owner.UID != "deployment-uid" {
+		t.Errorf("expected Deployment web, got %s %s", owner.Kind, owner.Name)
+	}
+
+	// Resolved owner is cached by the ReplicaSet UID
+	if err := client.Resource(replicaSetResource).Namespace("default").Delete(context.Background(), "web-abc", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	client.ClearActions()
+	owner, err = owners.resolve(context.Background(), "default", controllerRef("apps/v1", "ReplicaSet", "web-abc", "rs-uid"))
+	if err != nil {
+		t.Fatalf("expected cached owner, got error: %s", err)
+	}
+	if owner.Kind != "Deployment" {
+		t.Errorf("expected cached Deployment, got %s", owner.Kind)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls for a cached owner, got %v", actions)
+	}
+}
+
+func TestOwnerResolverStandaloneReplicaSet(t *testing.T) {
+	owners, _ := newTestOwnerResolver(replicaSet("standalone", "rs-uid", nil))
+
+	owner, err := owners.resolve(context.Background(), "default", controllerRef("apps/v1", "ReplicaSet", "standalone", "rs-uid"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if owner.Kind != "ReplicaSet" || owner.Name != "standalone" {
+		t.Errorf("expected ReplicaSet standalone, got %s %s", owner.Kind, owner.Name)
+	}
+}
+
+func TestOwnerResolverErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     *metav1.OwnerReference
+		wantErr string
+	}{
+		{
+			name:    "gone",
+			ref:     controllerRef("apps/v1", "ReplicaSet", "missing", "missing-uid"),
+			wantErr: "no longer exists",
+		},
+		{
+			name:    "replaced",
+			ref:     controllerRef("apps/v1", "ReplicaSet", "web-abc", "old-uid"),
+			wantErr: "was replaced",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			owners, _ := newTestOwnerResolver(replicaSet("web-abc", "rs-uid", nil))
+			_, err := owners.resolve(context.Background(), "default", test.ref)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("expected error %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+
+	owners := newOwnerResolver(nil, nil, nil)
+	if _, err := owners.resolve(context.Background(), "default", controllerRef("apps/v1", "ReplicaSet", "web-abc", "rs-uid")); err == nil {
+		t.Error("expected an error without a dynamic client")
+	}
+}
+
+func TestOwnerResolverCycle(t *testing.T) {
+	self := controllerRef("apps/v1", "ReplicaSet", "loop", "loop-uid")
+	owners, _ := newTestOwnerResolver(replicaSet("loop", "loop-uid", self))
+
+	_, err := owners.resolve(context.Background(), "default", self)
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("expected owner chain error, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package provisioner
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// WithAdoptOrphanedPVCs lets Provisioner take over an existing PVC with the requested name that has no controller.
+func WithAdoptOrphanedPVCs(adopt bool) Option {
+	return func(p *Provisioner) {
+		p.AdoptOrphanedPVCs = adopt
+	}
+}
+
+// existingPVC checks the PVC cache before any write.
+// Returns true if there is nothing to provision, either because the PVC is already ours or it conflicts.
+func (p *Provisioner) existingPVC(pod *corev1.Pod, owner metav1.OwnerReference, volumeName, claimName string) (bool, error) {
+	pvc, err := p.PVCLister.PersistentVolumeClaims(pod.ObjectMeta.Namespace).Get(claimName)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	controller := metav1.GetControllerOf(pvc)
+	if p.ownsPVC(owner.UID, pvc) {
+		klog.V(5).Infof("PVC %s/%s is already provisioned for %s %s", pvc.ObjectMeta.Namespace, claimName, owner.Kind, owner.Name)
+		return true, nil
+	}
+
+	if controller == nil && p.AdoptOrphanedPVCs {
+		return true, p.adoptPVC(pod, owner, volumeName, pvc)
+	}
+
+	var reason string
+	switch {
+	case controller != nil && controller.UID != owner.UID:
+		reason = fmt.Sprintf("is controlled by %s %s", controller.Kind, controller.Name)
+	case controller == nil:
+		reason = "has no owner, enable -adopt-orphaned-pvcs to take it over"
+	default:
+		reason = fmt.Sprintf("is not labeled %s=%s", LabelManagedBy, p.ControllerId)
+	}
+	p.Recorder.Event(pod, corev1.EventTypeWarning, ErrPVCConflict, fmt.Sprintf(MessagePVCConflict, volumeName, claimName, reason))
+	return true, nil
+}
+
+// ownsPVC returns true if the PVC was provisioned by this controller for the owner, see pvcOwner.
+func (p *Provisioner) ownsPVC(ownerUID types.UID, pvc *corev1.PersistentVolumeClaim) bool {
+	owner := metav1.GetControllerOf(pvc)
+	return owner != nil && owner.UID == ownerUID && pvc.ObjectMeta.Labels[LabelManagedBy] == p.ControllerId
+}
+
+func (p *Provisioner) adoptPVC(pod *corev1.Pod, owner metav1.OwnerReference, volumeName string, pvc *corev1.PersistentVolumeClaim) error {
+	pvcCopy := pvc.DeepCopy()
+	pvcCopy.ObjectMeta.OwnerReferences = append(pvcCopy.ObjectMeta.OwnerReferences, owner)
+	if pvcCopy.ObjectMeta.Labels == nil {
+		pvcCopy.ObjectMeta.Labels = make(map[string]string)
+	}
+	pvcCopy.ObjectMeta.Labels[LabelManagedBy] = p.ControllerId
+	stampPod(pvcCopy, pod)
+
+	_, err := p.KubeClientSet.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Update(p.Ctx, pvcCopy, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	p.Recorder.Event(pod, corev1.EventTypeNormal, PVCAdopted, fmt.Sprintf(MessagePVCAdopted, volumeName, pvc.ObjectMeta.Name))
+	return nil
+}
+
+// enqueueOwnerPod queues the pod that controls the PVC.
+func (p *Provisioner) enqueueOwnerPod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	owner := metav1.GetControllerOf(pvc)
+	if owner == nil || owner.Kind != "Pod" {
+		return
+	}
+	p.PodsQueue.Add(fmt.Sprintf("%s/%s", pvc.ObjectMeta.Namespace, owner.Name))
+}
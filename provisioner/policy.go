@@ -0,0 +1,178 @@
+package provisioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Namespace annotations
+	AnnotationAllowedStorageClassesKey = "allowed-storage-classes"
+	AnnotationAllowedStorageClasses    = AnnotationBaseName + "/" + AnnotationAllowedStorageClassesKey
+	AnnotationMaxClaimSizeKey          = "max-claim-size"
+	AnnotationMaxClaimSize             = AnnotationBaseName + "/" + AnnotationMaxClaimSizeKey
+	AnnotationMaxClaimsKey             = "max-claims"
+	AnnotationMaxClaims                = AnnotationBaseName + "/" + AnnotationMaxClaimsKey
+
+	PolicyWaitInterval = 30 * time.Second
+
+	// Created PVCs are counted towards max-claims until the informer cache catches up
+	createdClaimsSize = 1024
+	createdClaimsTTL  = time.Minute
+
+	MessageStorageClassNotAllowed = "'%s' SC %s is not allowed in namespace %s"
+	ErrStorageClassNotAllowed     = "ErrStorageClassNotAllowed"
+
+	MessageClaimTooLarge = "'%s' requested %s is more than %s allowed in namespace %s"
+	ErrClaimTooLarge     = "ErrClaimTooLarge"
+
+	MessageClaimQuotaExceeded = "'%s' namespace %s already has %d of %d PVCs in SC %s"
+	ErrClaimQuotaExceeded     = "ErrClaimQuotaExceeded"
+
+	MessageInvalidPolicy = "namespace %s has invalid '%s': %s"
+	ErrInvalidPolicy     = "ErrInvalidPolicy"
+)
+
+// WithNamespacePolicy restricts what pods can request with namespace annotations.
+func WithNamespacePolicy() Option {
+	return func(p *Provisioner) {
+		p.namespacePolicy = true
+	}
+}
+
+func (p *Provisioner) setupPolicy() {
+	namespaceInformer := p.KubeInformerFactory.Core().V1().Namespaces()
+	p.NamespaceLister = namespaceInformer.Lister()
+	p.NamespaceSynced = namespaceInformer.Informer().HasSynced
+
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		// Pods rejected by the old policy might be allowed now
+		UpdateFunc: func(old, new interface{}) {
+			namespace, ok := new.(*corev1.Namespace)
+			if !ok {
+				return
+			}
+			pods, err := p.PodsLister.Pods(namespace.ObjectMeta.Name).List(labels.Everything())
+			if err != nil {
+				klog.Errorf("Failed to list pods in namespace %s: %s", namespace.ObjectMeta.Name, err)
+				return
+			}
+			for _, pod := range pods {
+				if pod.Status.Phase == corev1.PodPending {
+					p.Enqueue(p.PodsQueue, pod)
+				}
+			}
+		},
+	})
+}
+
+// admitPVC checks the PVC against the policy of the pod namespace.
+// Returns false if the PVC must not be created, the reason is reported as a pod event.
+// Namespaces without policy annotations are not restricted.
+func (p *Provisioner) admitPVC(pod *corev1.Pod, volumeName string, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if !p.namespacePolicy {
+		return true, nil
+	}
+	namespaceName := pod.ObjectMeta.Namespace
+	namespace, err := p.NamespaceLister.Get(namespaceName)
+	if err != nil {
+		return false, err
+	}
+	annotations := namespace.ObjectMeta.Annotations
+
+	storageClass := ""
+	if pvc.Spec.StorageClassName != nil {
+		storageClass = *pvc.Spec.StorageClassName
+	}
+
+	if value, ok := annotations[AnnotationAllowedStorageClasses]; ok {
+		allowed := false
+		for _, allowedStorageClass := range strings.Split(value, ",") {
+			if storageClass != "" && strings.TrimSpace(allowedStorageClass) == storageClass {
+				allowed = true
+			}
+		}
+		if !allowed {
+			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrStorageClassNotAllowed,
+				fmt.Sprintf(MessageStorageClassNotAllowed, volumeName, storageClass, namespaceName))
+			return false, nil
+		}
+	}
+
+	if value, ok := annotations[AnnotationMaxClaimSize]; ok {
+		maxSize, err := resource.ParseQuantity(value)
+		if err != nil {
+			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrInvalidPolicy,
+				fmt.Sprintf(MessageInvalidPolicy, namespaceName, AnnotationMaxClaimSize, err))
+			return false, nil
+		}
+		size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if size.Cmp(maxSize) > 0 {
+			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrClaimTooLarge,
+				fmt.Sprintf(MessageClaimTooLarge, volumeName, size.String(), maxSize.String(), namespaceName))
+			return false, nil
+		}
+	}
+
+	if value, ok := annotations[AnnotationMaxClaims]; ok {
+		maxClaims, err := strconv.Atoi(value)
+		if err != nil || maxClaims < 0 {
+			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrInvalidPolicy,
+				fmt.Sprintf(MessageInvalidPolicy, namespaceName, AnnotationMaxClaims, fmt.Sprintf("%q is not a non-negative number", value)))
+			return false, nil
+		}
+		pvcs, err := p.PVCLister.PersistentVolumeClaims(namespaceName).List(labels.SelectorFromSet(labels.Set{
+			LabelManagedBy: p.ControllerId,
+		}))
+		if err != nil {
+			return false, err
+		}
+		claims := 0
+		cached := make(map[string]bool)
+		for _, existing := range pvcs {
+			cached[existing.ObjectMeta.Name] = true
+			if existing.ObjectMeta.DeletionTimestamp == nil && existing.Spec.StorageClassName != nil && *existing.Spec.StorageClassName == storageClass {
+				claims++
+			}
+		}
+		for _, key := range p.createdClaims.Keys() {
+			claimNamespace, claimName, _ := cache.SplitMetaNamespaceKey(key.(string))
+			if claimNamespace != namespaceName || cached[claimName] {
+				continue
+			}
+			if claimStorageClass, ok := p.createdClaims.Get(key); ok && claimStorageClass == storageClass {
+				claims++
+			}
+		}
+		if claims >= maxClaims {
+			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrClaimQuotaExceeded,
+				fmt.Sprintf(MessageClaimQuotaExceeded, volumeName, namespaceName, claims, maxClaims, storageClass))
+			// PVCs of other pods will be released eventually
+			p.PodsQueue.AddAfter(fmt.Sprintf("%s/%s", namespaceName, pod.ObjectMeta.Name), PolicyWaitInterval)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// claimCreated remembers a PVC created by Provisioner, so that pods synced before it shows up in the informer cache
+// can't exceed max-claims.
+func (p *Provisioner) claimCreated(pod *corev1.Pod, pvc *corev1.PersistentVolumeClaim) {
+	if !p.namespacePolicy {
+		return
+	}
+	storageClass := ""
+	if pvc.Spec.StorageClassName != nil {
+		storageClass = *pvc.Spec.StorageClassName
+	}
+	p.createdClaims.Add(fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pvc.ObjectMeta.Name), storageClass, createdClaimsTTL)
+}
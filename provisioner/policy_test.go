@@ -0,0 +1,175 @@
+package provisioner
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func policyTestPVC(name, storageClass, size string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{LabelManagedBy: "test"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func TestAdmitPVC(t *testing.T) {
+	terminating := policyTestPVC("terminating", "standard", "1Gi")
+	terminating.ObjectMeta.DeletionTimestamp = &metav1.Time{}
+	foreign := policyTestPVC("foreign", "standard", "1Gi")
+	foreign.ObjectMeta.Labels = nil
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		existing    []*corev1.PersistentVolumeClaim
+		created     []string
+		pvc         *corev1.PersistentVolumeClaim
+		disabled    bool
+		want        bool
+		wantReason  string
+	}{
+		{
+			name:        "policy disabled",
+			annotations: map[string]string{AnnotationAllowedStorageClasses: "fast"},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			disabled:    true,
+			want:        true,
+		},
+		{
+			name: "no policy",
+			pvc:  policyTestPVC("new", "standard", "1Gi"),
+			want: true,
+		},
+		{
+			name:        "allowed storage class",
+			annotations: map[string]string{AnnotationAllowedStorageClasses: "fast, standard"},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			want:        true,
+		},
+		{
+			name:        "storage class not allowed",
+			annotations: map[string]string{AnnotationAllowedStorageClasses: "fast"},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			wantReason:  ErrStorageClassNotAllowed,
+		},
+		{
+			name:        "claim size within limit",
+			annotations: map[string]string{AnnotationMaxClaimSize: "10Gi"},
+			pvc:         policyTestPVC("new", "standard", "10Gi"),
+			want:        true,
+		},
+		{
+			name:        "claim too large",
+			annotations: map[string]string{AnnotationMaxClaimSize: "10Gi"},
+			pvc:         policyTestPVC("new", "standard", "11Gi"),
+			wantReason:  ErrClaimTooLarge,
+		},
+		{
+			name:        "invalid claim size",
+			annotations: map[string]string{AnnotationMaxClaimSize: "big"},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			wantReason:  ErrInvalidPolicy,
+		},
+		{
+			name:        "invalid max claims",
+			annotations: map[string]string{AnnotationMaxClaims: "-1"},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			wantReason:  ErrInvalidPolicy,
+		},
+		{
+			name:        "claims within quota",
+			annotations: map[string]string{AnnotationMaxClaims: "2"},
+			existing:    []*corev1.PersistentVolumeClaim{policyTestPVC("one", "standard", "1Gi")},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			want:        true,
+		},
+		{
+			name:        "claim quota exceeded",
+			annotations: map[string]string{AnnotationMaxClaims: "1"},
+			existing:    []*corev1.PersistentVolumeClaim{policyTestPVC("one", "standard", "1Gi")},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			wantReason:  ErrClaimQuotaExceeded,
+		},
+		{
+			name:        "quota ignores terminating, foreign and other storage classes",
+			annotations: map[string]string{AnnotationMaxClaims: "1"},
+			existing: []*corev1.PersistentVolumeClaim{
+				terminating,
+				foreign,
+				policyTestPVC("fast", "fast", "1Gi"),
+			},
+			pvc:  policyTestPVC("new", "standard", "1Gi"),
+			want: true,
+		},
+		{
+			name:        "quota counts claims created before the cache caught up",
+			annotations: map[string]string{AnnotationMaxClaims: "2"},
+			existing:    []*corev1.PersistentVolumeClaim{policyTestPVC("one", "standard", "1Gi")},
+			created:     []string{"one", "two"},
+			pvc:         policyTestPVC("new", "standard", "1Gi"),
+			wantReason:  ErrClaimQuotaExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			_ = namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: test.annotations}})
+			pvcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			for _, pvc := range test.existing {
+				_ = pvcs.Add(pvc)
+			}
+			recorder := record.NewFakeRecorder(10)
+			p := &Provisioner{
+				NamespaceLister: corelisters.NewNamespaceLister(namespaces),
+				PVCLister:       corelisters.NewPersistentVolumeClaimLister(pvcs),
+				PodsQueue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+				createdClaims:   utilcache.NewLRUExpireCache(createdClaimsSize),
+				namespacePolicy: !test.disabled,
+			}
+			p.ControllerId = "test"
+			p.Recorder = recorder
+			defer p.PodsQueue.ShutDown()
+
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "build", Namespace: "default"}}
+			for _, name := range test.created {
+				p.claimCreated(pod, policyTestPVC(name, "standard", "1Gi"))
+			}
+
+			got, err := p.admitPVC(pod, "cache", test.pvc)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+			reason := ""
+			select {
+			case event := <-recorder.Events:
+				reason = strings.SplitN(event, " ", 3)[1]
+			default:
+			}
+			if reason != test.wantReason {
+				t.Errorf("expected event %q, got %q", test.wantReason, reason)
+			}
+		})
+	}
+}
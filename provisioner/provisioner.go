@@ -4,19 +4,24 @@ package provisioner
 import (
 	"context"
 	"fmt"
-	"strconv"
-	"strings"
 	"time"
 
 	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
@@ -45,16 +50,83 @@ const (
 	MessageMissingVolume = "Pod was missing volume '%s'"
 	ErrMissingVolume     = "ErrMissingVolume"
 
-	MessagePVCProvisionFailed = "PVC failed to create"
+	MessagePVCProvisionFailed = "'%s' PVC %s failed to create, will retry: %s"
 	ErrPVCProvisionFailed     = "ErrPVCProvisionFailed"
+
+	MessagePVCConflict = "'%s' PVC %s already exists and %s"
+	ErrPVCConflict     = "ErrPVCConflict"
+
+	PVCAdopted        = "PVCAdopted"
+	MessagePVCAdopted = "'%s' adopted orphaned PVC %s"
+
+	NamespaceSyncInterval = time.Second
 )
 
 type Provisioner struct {
 	controller.BasicController
 
+	NamespaceInformers *controller.NamespaceInformers
+	namespaceSelector  labels.Selector
+	podSelector        labels.Selector
+
 	PodsLister corelisters.PodLister
 	PodsSynced cache.InformerSynced
 	PodsQueue  workqueue.RateLimitingInterface
+
+	PVCLister corelisters.PersistentVolumeClaimLister
+	PVCSynced cache.InformerSynced
+	PVCQueue  workqueue.RateLimitingInterface
+
+	PVLister corelisters.PersistentVolumeLister
+	PVSynced cache.InformerSynced
+	SCLister storagelisters.StorageClassLister
+	SCSynced cache.InformerSynced
+
+	NamespaceLister corelisters.NamespaceLister
+	NamespaceSynced cache.InformerSynced
+
+	AdoptOrphanedPVCs bool
+	UngateOnBound     bool
+
+	SweepInterval     time.Duration
+	OrphanGracePeriod time.Duration
+
+	DynamicClient dynamic.Interface
+	RESTMapper    meta.RESTMapper
+
+	OwnerPassThroughKinds []string
+	owners                *ownerResolver
+
+	CheckoutNamespace string
+
+	cloneReports  *utilcache.LRUExpireCache
+	createdClaims *utilcache.LRUExpireCache
+
+	ClusterTemplateInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	ClusterTemplatesLister         cache.GenericLister
+	TemplatesSynced                []cache.InformerSynced
+
+	pvcTemplates         bool
+	storageClassFallback bool
+	namespacePolicy      bool
+}
+
+// Option configures optional Provisioner behavior.
+type Option func(*Provisioner)
+
+// WithNamespaceSelector watches only namespaces with matching labels, following label changes.
+// Takes precedence over the namespace New was called with.
+func WithNamespaceSelector(selector labels.Selector) Option {
+	return func(p *Provisioner) {
+		p.namespaceSelector = selector
+	}
+}
+
+// WithDynamicClient sets a client to work with optional CRDs such as VolumeSnapshots.
+func WithDynamicClient(client dynamic.Interface) Option {
+	return func(p *Provisioner) {
+		p.DynamicClient = client
+	}
 }
 
 func New(
@@ -62,21 +134,65 @@ func New(
 	kubeClientSet kubernetes.Interface,
 	namespace,
 	controllerId string,
+	opts ...Option,
 ) controller.Controller {
 	klog.Info("Provisioner starting...")
 
-	c := controller.New(ctx, kubeClientSet, namespace, AgentName, controllerId)
+	p := &Provisioner{
+		PodsQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pods"),
+		PVCQueue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "PVCs"),
+	}
 
-	podsInformer := c.KubeInformerFactory.Core().V1().Pods()
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.owners = newOwnerResolver(p.DynamicClient, p.RESTMapper, p.OwnerPassThroughKinds)
+	p.cloneReports = utilcache.NewLRUExpireCache(cloneReportsSize)
+	p.createdClaims = utilcache.NewLRUExpireCache(createdClaimsSize)
 
-	p := &Provisioner{
-		BasicController: *c,
-		PodsLister:      podsInformer.Lister(),
-		PodsSynced:      podsInformer.Informer().HasSynced,
-		PodsQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pods"),
+	namespaces := controller.SplitNamespaces(namespace)
+	if p.namespaceSelector != nil {
+		namespaces = []string{}
+	}
+	// Main informer factory only serves namespaced resources if there is a single static namespace
+	informerNamespace := ""
+	if len(namespaces) == 1 {
+		informerNamespace = namespaces[0]
+	}
+	p.BasicController = *controller.New(ctx, kubeClientSet, informerNamespace, AgentName, controllerId)
+
+	p.NamespaceInformers = controller.NewNamespaceInformers(kubeClientSet, time.Second*30, namespaces, p.namespaceSelector)
+	p.PodsLister = &podLister{informers: p.NamespaceInformers}
+	p.PVCLister = &pvcLister{informers: p.NamespaceInformers}
+	p.PodsSynced = p.NamespaceInformers.HasSynced
+	p.PVCSynced = p.NamespaceInformers.HasSynced
+
+	pvInformer := p.KubeInformerFactory.Core().V1().PersistentVolumes()
+	p.PVLister = pvInformer.Lister()
+	p.PVSynced = pvInformer.Informer().HasSynced
+	scInformer := p.KubeInformerFactory.Storage().V1().StorageClasses()
+	p.SCLister = scInformer.Lister()
+	p.SCSynced = scInformer.Informer().HasSynced
+
+	if p.pvcTemplates {
+		p.setupTemplates()
+	}
+	if p.namespacePolicy {
+		p.setupPolicy()
 	}
 
 	klog.V(2).Info("Setting up event handlers")
+	p.NamespaceInformers.AddSetup(p.setupNamespace)
+
+	return p
+}
+
+// setupNamespace registers pod and PVC informers of a newly watched namespace.
+func (p *Provisioner) setupNamespace(namespace string, factory kubeinformers.SharedInformerFactory) []cache.InformerSynced {
+	p.filterPods(namespace, factory)
+	podsInformer := factory.Core().V1().Pods()
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+
 	podsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			p.Enqueue(p.PodsQueue, obj)
@@ -88,8 +204,19 @@ func New(
 			p.Dequeue(p.PodsQueue, obj)
 		},
 	})
+	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: p.enqueueBoundPVC,
+		UpdateFunc: func(old, new interface{}) {
+			p.enqueueBoundPVC(new)
+		},
+		// Pending pod needs its PVC back
+		DeleteFunc: p.enqueueOwnerPod,
+	})
 
-	return p
+	return []cache.InformerSynced{
+		podsInformer.Informer().HasSynced,
+		pvcInformer.Informer().HasSynced,
+	}
 }
 
 func (p *Provisioner) Run(threadiness int, stopCh <-chan struct{}) error {
@@ -98,10 +225,21 @@ func (p *Provisioner) Run(threadiness int, stopCh <-chan struct{}) error {
 		stopCh,
 		func(threadiness int, stopCh <-chan struct{}) error {
 			klog.V(2).Info("Waiting for informer caches to sync")
-			if ok := cache.WaitForCacheSync(stopCh, p.PodsSynced); !ok {
+			p.NamespaceInformers.Start(stopCh)
+			p.startTemplates(stopCh)
+			synced := append([]cache.InformerSynced{p.PodsSynced, p.PVCSynced, p.PVSynced, p.SCSynced}, p.TemplatesSynced...)
+			if p.NamespaceSynced != nil {
+				synced = append(synced, p.NamespaceSynced)
+			}
+			if ok := cache.WaitForCacheSync(stopCh, synced...); !ok {
 				return fmt.Errorf("failed to wait for caches to sync")
 			}
 
+			go p.scanUnlabeledPods(p.Ctx)
+			if p.SweepInterval > 0 {
+				go wait.Until(p.sweepOrphans, p.SweepInterval, stopCh)
+			}
+
 			klog.V(2).Info("Starting workers")
 			for i := 0; i < threadiness; i++ {
 				go wait.Until(
@@ -110,6 +248,11 @@ func (p *Provisioner) Run(threadiness int, stopCh <-chan struct{}) error {
 					stopCh,
 				)
 			}
+			go wait.Until(
+				p.RunWorker("pvc", p.PVCQueue, p.pvcSyncHandler),
+				time.Second,
+				stopCh,
+			)
 
 			return nil
 		},
@@ -117,6 +260,9 @@ func (p *Provisioner) Run(threadiness int, stopCh <-chan struct{}) error {
 			if p.PodsQueue != nil {
 				p.PodsQueue.ShutDown()
 			}
+			if p.PVCQueue != nil {
+				p.PVCQueue.ShutDown()
+			}
 		},
 	)
 }
@@ -128,6 +274,13 @@ func (p *Provisioner) Stop() {
 }
 
 func (p *Provisioner) podSyncHandler(namespace, name string) error {
+	if p.NamespaceInformers.Factory(namespace) != nil && !p.NamespaceInformers.NamespaceSynced(namespace) {
+		// Namespace was just added and existing PVCs would be missed, come back once its caches are filled
+		klog.V(5).Infof("namespace %q is not synced yet, requeue pod %s", namespace, name)
+		p.PodsQueue.AddAfter(fmt.Sprintf("%s/%s", namespace, name), NamespaceSyncInterval)
+		return nil
+	}
+
 	pod, err := p.PodsLister.Pods(namespace).Get(name)
 	if err != nil {
 		if errors.IsNotFound(err) {
@@ -140,6 +293,17 @@ func (p *Provisioner) podSyncHandler(namespace, name string) error {
 		return err
 	}
 
+	if podTerminated(pod) {
+		if usesCheckout(pod) {
+			if err := p.releaseCheckouts(pod); err != nil {
+				return err
+			}
+		}
+		if err := p.releaseOnFinish(pod); err != nil {
+			return err
+		}
+	}
+
 	if pod.Status.Phase != corev1.PodPending {
 		klog.V(5).Info(
 			fmt.Sprintf("pod '%s/%s' is not in '%s' status, skip", namespace, name, corev1.PodPending),
@@ -147,43 +311,9 @@ func (p *Provisioner) podSyncHandler(namespace, name string) error {
 		return nil
 	}
 
-	annotations := pod.ObjectMeta.Annotations
 	volumes := pod.Spec.Volumes
 
-	// key: volumeName, value: claimName or "" if not found on the pod
-	requestedVolumes := map[string]string{}
-	for key, value := range annotations {
-		keyParts := strings.Split(key, "/")
-		klog.V(6).Info(fmt.Sprintf("keyParts: %s", keyParts))
-		if len(keyParts) != 2 || keyParts[0] != AnnotationBaseName {
-			continue
-		}
-		keySubParts := strings.Split(keyParts[1], ".")
-		klog.V(6).Info(fmt.Sprintf("keySubParts: %s", keySubParts))
-		if len(keySubParts) != 2 || keySubParts[1] != AnnotationEnabledKey {
-			continue
-		}
-		requestedVolumeName := keySubParts[0]
-
-		enabled, err := strconv.ParseBool(value)
-		if err != nil || !enabled {
-			klog.V(5).Info(fmt.Sprintf("'%s: %v', skip", key, value))
-			continue
-		}
-
-		pvcKey := fmt.Sprintf("%s/%s.%s", AnnotationBaseName, requestedVolumeName, AnnotationPVCKey)
-		if _, ok := annotations[pvcKey]; !ok {
-			p.Recorder.Event(
-				pod,
-				corev1.EventTypeWarning,
-				ErrMissingPVC,
-				fmt.Sprintf(MessageMissingPVC, pvcKey),
-			)
-			continue
-		}
-		requestedVolumes[requestedVolumeName] = ""
-	}
-
+	requestedVolumes := p.volumeRequests(pod)
 	if len(requestedVolumes) <= 0 {
 		klog.V(5).Info(
 			fmt.Sprintf("pod '%s/%s' did not requested any volumes, skip", namespace, name),
@@ -192,7 +322,7 @@ func (p *Provisioner) podSyncHandler(namespace, name string) error {
 	}
 
 	for _, volume := range volumes {
-		_, ok := requestedVolumes[volume.Name]
+		request, ok := requestedVolumes[volume.Name]
 		if !ok {
 			klog.V(5).Info(
 				fmt.Sprintf("pod '%s/%s' volume '%s' is not one of the requested, skip",
@@ -213,13 +343,15 @@ func (p *Provisioner) podSyncHandler(namespace, name string) error {
 			continue
 		}
 
-		requestedVolumes[volume.Name] = volume.VolumeSource.PersistentVolumeClaim.ClaimName
+		request.claimName = volume.VolumeSource.PersistentVolumeClaim.ClaimName
 		klog.V(4).Info(
-			fmt.Sprintf("matched volume=%s to pvc=%s", volume.Name, requestedVolumes[volume.Name]),
+			fmt.Sprintf("matched volume=%s to pvc=%s", volume.Name, request.claimName),
 		)
 	}
 
-	for requestedVolume, claimName := range requestedVolumes {
+	created := make(map[string]bool)
+	for requestedVolume, request := range requestedVolumes {
+		claimName := request.claimName
 		if claimName == "" {
 			p.Recorder.Event(
 				pod,
@@ -230,9 +362,24 @@ func (p *Provisioner) podSyncHandler(namespace, name string) error {
 			continue
 		}
 
-		pvcYaml := annotations[fmt.Sprintf("%s/%s.%s", AnnotationBaseName, requestedVolume, AnnotationPVCKey)]
-		decode := scheme.Codecs.UniversalDeserializer().Decode
-		obj, _, err := decode([]byte(pvcYaml), nil, nil)
+		owner, err := p.pvcOwner(pod, request)
+		if err != nil {
+			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrPVCOwner, fmt.Sprintf(MessagePVCOwner, requestedVolume, err))
+			continue
+		}
+
+		provisioned, err := p.existingPVC(pod, owner, requestedVolume, claimName)
+		if err != nil {
+			return err
+		}
+		if provisioned {
+			if err := p.rerouteUnbound(pod, owner, requestedVolume, request, claimName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		pvc, err := p.requestedPVC(pod, request)
 		if err != nil {
 			p.Recorder.Event(
 				pod,
@@ -242,46 +389,102 @@ func (p *Provisioner) podSyncHandler(namespace, name string) error {
 			)
 			continue
 		}
-		typeOk := func() bool {
-			switch t := obj.(type) {
-			case *corev1.PersistentVolumeClaim:
-				return true
-			default:
-				p.Recorder.Event(
-					pod,
-					corev1.EventTypeWarning,
-					ErrInvalidPVC,
-					fmt.Sprintf(MessageInvalidPVC, requestedVolume,
-						fmt.Sprintf("expected pvc, got: %s", t)),
-				)
-				return false
-			}
-		}()
-		if !typeOk {
+		if err := p.routePVC(pod, requestedVolume, request, pvc); err != nil {
+			p.Recorder.Event(
+				pod,
+				corev1.EventTypeWarning,
+				ErrInvalidPVC,
+				fmt.Sprintf(MessageInvalidPVC, requestedVolume, err),
+			)
 			continue
 		}
-		pvc := obj.(*corev1.PersistentVolumeClaim)
 
 		pvc.ObjectMeta.Name = claimName
-		pvc.ObjectMeta.OwnerReferences = []metav1.OwnerReference{
-			*metav1.NewControllerRef(pod, corev1.SchemeGroupVersion.WithKind("Pod")),
-		}
+		pvc.ObjectMeta.OwnerReferences = []metav1.OwnerReference{owner}
 		if pvc.ObjectMeta.Labels == nil {
 			pvc.ObjectMeta.Labels = make(map[string]string)
 		}
 		pvc.ObjectMeta.Labels[fmt.Sprintf("%s/%s", LabelBaseName, LabelManagedByKey)] = p.ControllerId
-		_, err = p.KubeClientSet.CoreV1().PersistentVolumeClaims(pod.ObjectMeta.Namespace).
-			Create(p.Ctx, pvc, metav1.CreateOptions{})
+		stampPod(pvc, pod)
+
+		admitted, err := p.admitPVC(pod, requestedVolume, pvc)
 		if err != nil {
-			if errors.IsAlreadyExists(err) {
+			return err
+		}
+		if !admitted {
+			continue
+		}
+
+		mode := request.Options[AnnotationModeKey]
+		switch mode {
+		case "", ModeExclusive:
+		case ModeClone:
+			p.clone(pod, requestedVolume, pvc)
+		case ModeCheckout:
+			checkedOut, err := p.checkout(pod, requestedVolume, pvc)
+			if err != nil {
+				p.Recorder.Event(pod, corev1.EventTypeWarning, ErrCheckout, fmt.Sprintf(MessageCheckout, requestedVolume, err))
+				return err
+			}
+			if !checkedOut {
+				p.Recorder.Event(
+					pod,
+					corev1.EventTypeNormal,
+					CheckoutWaiting,
+					fmt.Sprintf(MessageCheckoutWaiting, requestedVolume, *pvc.Spec.StorageClassName),
+				)
+				p.PodsQueue.AddAfter(fmt.Sprintf("%s/%s", namespace, name), CheckoutWaitInterval)
 				continue
 			}
+		default:
+			p.Recorder.Event(
+				pod,
+				corev1.EventTypeWarning,
+				ErrInvalidPVC,
+				fmt.Sprintf(MessageInvalidPVC, requestedVolume, fmt.Sprintf("unknown mode %q", mode)),
+			)
+			continue
+		}
+		p.seed(pod, requestedVolume, pvc)
 
-			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrPVCProvisionFailed, MessagePVCProvisionFailed)
+		ok, err := p.createPVC(pod, requestedVolume, pvc)
+		if err != nil {
 			return err
 		}
+		if !ok {
+			continue
+		}
+		created[requestedVolume] = true
+		p.claimCreated(pod, pvc)
 		p.Recorder.Event(pod, corev1.EventTypeNormal, PVCProvisioned, MessagePVCProvisioned)
 	}
 
-	return nil
+	return p.ungate(pod, requestedVolumes, created)
+}
+
+// requestedPVC returns the PVC for the volume, either from a template or from the inline YAML.
+func (p *Provisioner) requestedPVC(pod *corev1.Pod, request *VolumeRequest) (*corev1.PersistentVolumeClaim, error) {
+	pvcYaml := request.PVC
+	if request.Template != "" {
+		var err error
+		if pvcYaml, err = p.templatePVCYaml(pod, request.Template); err != nil {
+			return nil, err
+		}
+	}
+
+	pvcYaml, err := p.renderPVC(pod, request.Volume, pvcYaml)
+	if err != nil {
+		return nil, err
+	}
+
+	decode := scheme.Codecs.UniversalDeserializer().Decode
+	obj, _, err := decode([]byte(pvcYaml), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		return nil, fmt.Errorf("expected pvc, got: %s", obj)
+	}
+	return pvc, nil
 }
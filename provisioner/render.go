@@ -0,0 +1,178 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// RenderPod is the subset of the pod available to PVC templates.
+type RenderPod struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// RenderData is what PVC templates are rendered with, i.e. `{{ .Pod.Labels.job }}`.
+type RenderData struct {
+	Pod          RenderPod
+	Volume       string
+	ControllerId string
+}
+
+var dnsLabelInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// renderFuncs are the only functions available to PVC templates besides text/template builtins.
+var renderFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"trunc": func(n int, s string) string {
+		if len(s) <= n {
+			return s
+		}
+		return s[:n]
+	},
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+	// dnsLabel makes a value safe to use as a label value or a name
+	"dnsLabel": func(s string) string {
+		s = dnsLabelInvalid.ReplaceAllString(strings.ToLower(s), "-")
+		if len(s) > 63 {
+			s = s[:63]
+		}
+		return strings.Trim(s, "-")
+	},
+}
+
+// templateAction matches a text/template action, i.e. `{{ .Pod.Name }}`.
+var templateAction = regexp.MustCompile(`(?s){{.*?}}`)
+
+// renderPlaceholder stands in for a template action while the PVC YAML is decoded.
+const (
+	renderPlaceholderPrefix = "__dynamic_pvc_provisioner_action_"
+	renderPlaceholder       = renderPlaceholderPrefix + "%d__"
+)
+
+// renderPVC renders template actions in the PVC YAML with pod-derived values.
+// Actions are only rendered within string values and keys of the decoded YAML, so that a value such as a pod label
+// can't add fields to the PVC. The result is the PVC as JSON.
+// A missing label or annotation renders as an empty string.
+func (p *Provisioner) renderPVC(pod *corev1.Pod, volumeName, pvcYaml string) (string, error) {
+	if !strings.Contains(pvcYaml, "{{") {
+		return pvcYaml, nil
+	}
+	if _, err := newRenderTemplate(volumeName, pvcYaml); err != nil {
+		return "", err
+	}
+
+	actions := []string{}
+	placeholders := templateAction.ReplaceAllStringFunc(pvcYaml, func(action string) string {
+		actions = append(actions, action)
+		return fmt.Sprintf(renderPlaceholder, len(actions)-1)
+	})
+	var decoded interface{}
+	if err := yaml.Unmarshal([]byte(placeholders), &decoded); err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+
+	data := RenderData{
+		Pod: RenderPod{
+			Name:        pod.ObjectMeta.Name,
+			Namespace:   pod.ObjectMeta.Namespace,
+			Labels:      pod.ObjectMeta.Labels,
+			Annotations: pod.ObjectMeta.Annotations,
+		},
+		Volume:       volumeName,
+		ControllerId: p.ControllerId,
+	}
+	if data.Pod.Labels == nil {
+		data.Pod.Labels = map[string]string{}
+	}
+	if data.Pod.Annotations == nil {
+		data.Pod.Annotations = map[string]string{}
+	}
+
+	render := func(value string) (string, error) {
+		if !strings.Contains(value, renderPlaceholderPrefix) {
+			return value, nil
+		}
+		for i, action := range actions {
+			value = strings.ReplaceAll(value, fmt.Sprintf(renderPlaceholder, i), action)
+		}
+		t, err := newRenderTemplate(volumeName, value)
+		if err != nil {
+			return "", err
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, data); err != nil {
+			return "", fmt.Errorf("failed to render template: %w", err)
+		}
+		return out.String(), nil
+	}
+	rendered, err := renderStrings(decoded, render)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := json.Marshal(rendered)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func newRenderTemplate(name, text string) (*template.Template, error) {
+	// A missing map key is an empty string, so that `default` works for labels and annotations
+	t, err := template.New(name).Option("missingkey=zero").Funcs(renderFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return t, nil
+}
+
+// renderStrings renders every string value and key of the decoded YAML.
+func renderStrings(value interface{}, render func(string) (string, error)) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		return render(value)
+	case []interface{}:
+		items := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			rendered, err := renderStrings(item, render)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, rendered)
+		}
+		return items, nil
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			renderedKey, err := render(key)
+			if err != nil {
+				return nil, err
+			}
+			rendered, err := renderStrings(field, render)
+			if err != nil {
+				return nil, err
+			}
+			fields[renderedKey] = rendered
+		}
+		return fields, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,160 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderPVC(t *testing.T) {
+	p := &Provisioner{BasicController: controller.BasicController{ControllerId: "ci"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "build-42",
+			Namespace:   "jenkins",
+			Labels:      map[string]string{"job": "My_Project/main", "empty": ""},
+			Annotations: map[string]string{"team": " Platform "},
+		},
+	}
+	injecting := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "build-42",
+			Namespace: "jenkins",
+			Labels:    map[string]string{"job": "x\nspec:\n  storageClassName: other", "key": "a: b"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		yaml    string
+		want    interface{}
+		wantErr string
+	}{
+		{
+			name: "pod fields",
+			yaml: "value: {{ .Pod.Namespace }}/{{ .Pod.Name }} {{ .Volume }} {{ .ControllerId }}",
+			want: map[string]string{"value": "jenkins/build-42 cache ci"},
+		},
+		{
+			name: "labels and annotations",
+			yaml: "value: {{ .Pod.Labels.job }} {{ index .Pod.Annotations \"team\" | trim | lower }}",
+			want: map[string]string{"value": "My_Project/main platform"},
+		},
+		{
+			name: "quoted",
+			yaml: "value: \"{{ .Pod.Name }}\"",
+			want: map[string]string{"value": "build-42"},
+		},
+		{
+			name: "key",
+			yaml: "{{ .Volume }}-key: value",
+			want: map[string]string{"cache-key": "value"},
+		},
+		{
+			name: "nested",
+			yaml: "metadata:\n  labels:\n    job: {{ .Pod.Labels.job | dnsLabel }}\nspec:\n  accessModes: [\"{{ .Volume }}\"]\n  size: 1\n",
+			want: map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]string{"job": "my-project-main"}},
+				"spec":     map[string]interface{}{"accessModes": []string{"cache"}, "size": 1},
+			},
+		},
+		{
+			name: "dnsLabel truncates",
+			yaml: "value: {{ dnsLabel \"" + strings.Repeat("a", 62) + "_b\" }}",
+			want: map[string]string{"value": strings.Repeat("a", 62)},
+		},
+		{
+			name: "default",
+			yaml: "value: {{ .Pod.Labels.empty | default \"none\" }} {{ .Pod.Labels.job | default \"none\" }}",
+			want: map[string]string{"value": "none My_Project/main"},
+		},
+		{
+			name: "trunc and replace",
+			yaml: "value: {{ .Pod.Name | trunc 5 }} {{ .Pod.Name | replace \"-\" \".\" }} {{ .Pod.Name | upper }}",
+			want: map[string]string{"value": "build build.42 BUILD-42"},
+		},
+		{
+			name: "pod without labels",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "build-42", Namespace: "jenkins"}},
+			yaml: "value: {{ .Pod.Labels.job | default \"none\" }}",
+			want: map[string]string{"value": "none"},
+		},
+		{
+			name: "missing key",
+			yaml: "value: {{ .Pod.Labels.missing }}",
+			want: map[string]string{"value": ""},
+		},
+		{
+			name: "value can't add fields",
+			pod:  injecting,
+			yaml: "metadata:\n  labels:\n    job: {{ .Pod.Labels.job }}\n    key: {{ .Pod.Labels.key }}\n",
+			want: map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]string{
+					"job": "x\nspec:\n  storageClassName: other",
+					"key": "a: b",
+				}},
+			},
+		},
+		{
+			name:    "action across values",
+			yaml:    "a: {{ if .Volume }}\nb: {{ end }}",
+			wantErr: "invalid template",
+		},
+		{
+			name:    "unknown field",
+			yaml:    "value: {{ .Pod.Missing }}",
+			wantErr: "failed to render template",
+		},
+		{
+			name:    "invalid template",
+			yaml:    "value: {{ .Pod.Name",
+			wantErr: "invalid template",
+		},
+		{
+			name:    "unknown function",
+			yaml:    "value: {{ env \"HOME\" }}",
+			wantErr: "invalid template",
+		},
+		{
+			name:    "invalid YAML",
+			yaml:    "value: [{{ .Volume }}",
+			wantErr: "invalid template",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testPod := test.pod
+			if testPod == nil {
+				testPod = pod
+			}
+			got, err := p.renderPVC(testPod, "cache", test.yaml)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected error %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want, err := json.Marshal(test.want)
+			if err != nil {
+				t.Fatalf("invalid test: %s", err)
+			}
+			if got != string(want) {
+				t.Errorf("expected %s, got %s", want, got)
+			}
+		})
+	}
+
+	noTemplate := "spec:\n  storageClassName: standard\n"
+	if got, err := p.renderPVC(pod, "cache", noTemplate); err != nil || got != noTemplate {
+		t.Errorf("expected YAML without actions as is, got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,117 @@
+package provisioner
+
+import (
+	"fmt"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// PVC template annotations
+	AnnotationSeedKey = "seed"
+	AnnotationSeed    = AnnotationBaseName + "/" + AnnotationSeedKey
+
+	SeedGolden = "golden"
+
+	MessageSeedPVC = "'%s' failed to find a seed: %s"
+	ErrSeedPVC     = "ErrSeedPVC"
+
+	MessageSeedNamespace = "'%s' golden snapshots of SC %s are taken in namespace %s, they can't seed PVCs in %s; " +
+		"see %s of the SC"
+)
+
+// seed points an opted in PVC at the latest ready golden snapshot of its Storage Class.
+// PVC is left intact if it already has a data source or there are no golden snapshots yet.
+func (p *Provisioner) seed(pod *corev1.Pod, volumeName string, pvc *corev1.PersistentVolumeClaim) {
+	seed, ok := pvc.ObjectMeta.Annotations[AnnotationSeed]
+	if !ok || pvc.Spec.DataSource != nil || pvc.Spec.DataSourceRef != nil {
+		return
+	}
+	if seed != SeedGolden {
+		p.Recorder.Event(
+			pod,
+			corev1.EventTypeWarning,
+			ErrSeedPVC,
+			fmt.Sprintf(MessageSeedPVC, volumeName, fmt.Sprintf("unknown seed %q", seed)),
+		)
+		return
+	}
+	if p.DynamicClient == nil || pvc.Spec.StorageClassName == nil {
+		p.Recorder.Event(
+			pod,
+			corev1.EventTypeWarning,
+			ErrSeedPVC,
+			fmt.Sprintf(MessageSeedPVC, volumeName, "storageClassName must be set and snapshots must be enabled"),
+		)
+		return
+	}
+
+	releaserId, err := p.releaserOf(*pvc.Spec.StorageClassName)
+	if err != nil {
+		p.Recorder.Event(pod, corev1.EventTypeWarning, ErrSeedPVC, fmt.Sprintf(MessageSeedPVC, volumeName, err))
+		return
+	}
+	selector := labels.SelectorFromSet(labels.Set{
+		pool.LabelManagedBy:    releaserId,
+		pool.LabelStorageClass: *pvc.Spec.StorageClassName,
+		pool.LabelSnapshot:     pool.SnapshotGolden,
+	}).String()
+
+	snapshots := p.DynamicClient.Resource(pool.VolumeSnapshotResource)
+	list, err := snapshots.Namespace(pod.ObjectMeta.Namespace).List(p.Ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		p.Recorder.Event(pod, corev1.EventTypeWarning, ErrSeedPVC, fmt.Sprintf(MessageSeedPVC, volumeName, err))
+		return
+	}
+	if len(list.Items) == 0 {
+		// A snapshot can only seed PVCs in its own namespace, tell apart a misconfiguration from no snapshots yet
+		p.seedElsewhere(pod, volumeName, *pvc.Spec.StorageClassName)
+		return
+	}
+
+	var latest *unstructured.Unstructured
+	for i, snapshot := range list.Items {
+		if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !ready {
+			continue
+		}
+		if latest == nil || latest.GetCreationTimestamp().Time.Before(snapshot.GetCreationTimestamp().Time) {
+			latest = &list.Items[i]
+		}
+	}
+	if latest == nil {
+		return
+	}
+
+	apiGroup := pool.VolumeSnapshotResource.Group
+	pvc.Spec.DataSource = &corev1.TypedLocalObjectReference{
+		APIGroup: &apiGroup,
+		Kind:     "VolumeSnapshot",
+		Name:     latest.GetName(),
+	}
+}
+
+// seedElsewhere warns if golden snapshots of the Storage Class are taken in another namespace than the pod's.
+// Without the annotation they are taken in -helper-namespace of the Releaser, which Provisioner doesn't know.
+func (p *Provisioner) seedElsewhere(pod *corev1.Pod, volumeName, storageClass string) {
+	sc, err := p.SCLister.Get(storageClass)
+	if err != nil {
+		klog.Warningf("Failed to check where golden snapshots of SC %s are taken: %s", storageClass, err)
+		return
+	}
+	namespace, ok := sc.ObjectMeta.Annotations[pool.AnnotationGoldenSnapshotNamespace]
+	if !ok || namespace == pod.ObjectMeta.Namespace {
+		klog.V(4).Infof("No golden snapshots of SC %s for %s/%s volume %s yet", storageClass, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, volumeName)
+		return
+	}
+	p.Recorder.Event(
+		pod,
+		corev1.EventTypeWarning,
+		ErrSeedPVC,
+		fmt.Sprintf(MessageSeedNamespace, volumeName, storageClass, namespace, pod.ObjectMeta.Namespace, pool.AnnotationGoldenSnapshotNamespace),
+	)
+}
@@ -0,0 +1,95 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/pager"
+	"k8s.io/klog/v2"
+)
+
+// maxUnlabeledPods is how many pods missed by the pod selector are named in the startup warning
+const maxUnlabeledPods = 10
+
+// WithPodSelector only lists and watches pods matching the selector, i.e. `dynamic-pvc-provisioner.kubernetes.io/enabled=true`.
+// Pods with Provisioner annotations but without matching labels are ignored.
+func WithPodSelector(selector labels.Selector) Option {
+	return func(p *Provisioner) {
+		p.podSelector = selector
+	}
+}
+
+// filterPods makes the factory use a filtered pod informer, it must be called before any pod informer is requested.
+func (p *Provisioner) filterPods(namespace string, factory kubeinformers.SharedInformerFactory) {
+	if p.podSelector == nil {
+		return
+	}
+	factory.InformerFor(&corev1.Pod{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return coreinformers.NewFilteredPodInformer(
+			client,
+			namespace,
+			resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+			func(options *metav1.ListOptions) {
+				options.LabelSelector = p.podSelector.String()
+			},
+		)
+	})
+}
+
+// hasProvisionerAnnotations returns true if the pod asks Provisioner for volumes in any format.
+func hasProvisionerAnnotations(pod *corev1.Pod) bool {
+	for key := range pod.ObjectMeta.Annotations {
+		if strings.HasPrefix(key, AnnotationBaseName+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// scanUnlabeledPods lists pods once, page by page, and warns about annotated pods the pod selector does not match.
+func (p *Provisioner) scanUnlabeledPods(ctx context.Context) {
+	if p.podSelector == nil {
+		return
+	}
+
+	unlabeled := []string{}
+	count := 0
+	for _, namespace := range p.NamespaceInformers.Namespaces() {
+		listPager := pager.New(pager.SimplePageFunc(func(options metav1.ListOptions) (runtime.Object, error) {
+			return p.KubeClientSet.CoreV1().Pods(namespace).List(ctx, options)
+		}))
+		err := listPager.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok || !hasProvisionerAnnotations(pod) || p.podSelector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+				return nil
+			}
+			count++
+			if len(unlabeled) < maxUnlabeledPods {
+				unlabeled = append(unlabeled, fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name))
+			}
+			return nil
+		})
+		if err != nil {
+			klog.Errorf("Failed to scan pods in namespace %q for missing labels: %s", namespace, err.Error())
+			return
+		}
+	}
+
+	if count > 0 {
+		klog.Warningf(
+			"%d pods have %s annotations but don't match -pod-selector %s and will be ignored, i.e.: %s",
+			count, AnnotationBaseName, p.podSelector.String(), strings.Join(unlabeled, ", "),
+		)
+	}
+}
@@ -0,0 +1,160 @@
+package provisioner
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// PVC annotations, pod-uid is shared with checkout Leases
+	AnnotationPodNameKey    = "pod-name"
+	AnnotationPodName       = AnnotationBaseName + "/" + AnnotationPodNameKey
+	AnnotationOrphanedAtKey = "orphaned-at"
+	AnnotationOrphanedAt    = AnnotationBaseName + "/" + AnnotationOrphanedAtKey
+
+	DefaultOrphanGracePeriod = 10 * time.Minute
+
+	PVCSwept        = "PVCSwept"
+	MessagePVCSwept = "PVC deleted as pod %s (uid %s) is gone since %s"
+)
+
+// WithOrphanSweep periodically deletes managed PVCs whose pod is gone, once they stayed orphaned for the grace period.
+func WithOrphanSweep(interval, gracePeriod time.Duration) Option {
+	return func(p *Provisioner) {
+		p.SweepInterval = interval
+		p.OrphanGracePeriod = gracePeriod
+	}
+}
+
+// stampPod records the pod on the PVC, so that it can be found even if the owner reference is lost.
+func stampPod(pvc *corev1.PersistentVolumeClaim, pod *corev1.Pod) {
+	if pvc.ObjectMeta.Annotations == nil {
+		pvc.ObjectMeta.Annotations = make(map[string]string)
+	}
+	pvc.ObjectMeta.Annotations[AnnotationPodName] = pod.ObjectMeta.Name
+	pvc.ObjectMeta.Annotations[AnnotationPodUID] = string(pod.ObjectMeta.UID)
+}
+
+// pvcPod returns the pod the PVC was provisioned for, either from the owner reference or from the annotations.
+// Returns false for PVCs owned by a controller other than a pod, their lifetime is up to the garbage collector.
+func pvcPod(pvc *corev1.PersistentVolumeClaim) (string, types.UID, bool) {
+	if owner := metav1.GetControllerOf(pvc); owner != nil {
+		if owner.Kind != "Pod" {
+			return "", "", false
+		}
+		return owner.Name, owner.UID, true
+	}
+	name, uid := pvc.ObjectMeta.Annotations[AnnotationPodName], pvc.ObjectMeta.Annotations[AnnotationPodUID]
+	if name == "" || uid == "" {
+		return "", "", false
+	}
+	return name, types.UID(uid), true
+}
+
+// podExists checks the cache first and confirms a miss with the API server,
+// as the cache may be behind or filtered with a pod selector.
+func (p *Provisioner) podExists(namespace, name string, uid types.UID) (bool, error) {
+	pod, err := p.PodsLister.Pods(namespace).Get(name)
+	if err == nil && pod.ObjectMeta.UID == uid {
+		return true, nil
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	pod, err = p.KubeClientSet.CoreV1().Pods(namespace).Get(p.Ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return pod.ObjectMeta.UID == uid, nil
+}
+
+// sweepOrphans finds managed PVCs whose pod no longer exists or was replaced by another pod with the same name.
+// They are marked first and deleted once the grace period passes.
+func (p *Provisioner) sweepOrphans() {
+	pvcs, err := p.PVCLister.List(labels.SelectorFromSet(labels.Set{
+		LabelManagedBy: p.ControllerId,
+	}))
+	if err != nil {
+		klog.Errorf("Failed to list PVCs to sweep: %s", err.Error())
+		return
+	}
+
+	for _, pvc := range pvcs {
+		if err := p.sweepPVC(pvc); err != nil {
+			klog.Errorf("Failed to sweep PVC %s/%s: %s", pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name, err.Error())
+		}
+	}
+}
+
+func (p *Provisioner) sweepPVC(pvc *corev1.PersistentVolumeClaim) error {
+	if pvc.ObjectMeta.DeletionTimestamp != nil {
+		return nil
+	}
+	podName, podUID, ok := pvcPod(pvc)
+	if !ok {
+		klog.V(5).Infof("PVC %s/%s has no pod to check, skip", pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+		return nil
+	}
+	exists, err := p.podExists(pvc.ObjectMeta.Namespace, podName, podUID)
+	if err != nil {
+		return err
+	}
+
+	orphanedAt, marked := pvc.ObjectMeta.Annotations[AnnotationOrphanedAt]
+	if exists {
+		if marked {
+			// Should not happen as pods are not recreated with the same UID, but never delete a PVC in use
+			pvcCopy := pvc.DeepCopy()
+			delete(pvcCopy.ObjectMeta.Annotations, AnnotationOrphanedAt)
+			_, err := p.KubeClientSet.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Update(p.Ctx, pvcCopy, metav1.UpdateOptions{})
+			if err != nil && !errors.IsConflict(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !marked {
+		klog.V(4).Infof("PVC %s/%s is orphaned, pod %s (uid %s) is gone", pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name, podName, podUID)
+		pvcCopy := pvc.DeepCopy()
+		if pvcCopy.ObjectMeta.Annotations == nil {
+			pvcCopy.ObjectMeta.Annotations = make(map[string]string)
+		}
+		pvcCopy.ObjectMeta.Annotations[AnnotationOrphanedAt] = time.Now().UTC().Format(time.RFC3339)
+		_, err := p.KubeClientSet.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Update(p.Ctx, pvcCopy, metav1.UpdateOptions{})
+		if err != nil && !errors.IsConflict(err) {
+			return err
+		}
+		return nil
+	}
+
+	since, err := time.Parse(time.RFC3339, orphanedAt)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", AnnotationOrphanedAt, orphanedAt, err)
+	}
+	if time.Since(since) < p.OrphanGracePeriod {
+		return nil
+	}
+
+	err = p.KubeClientSet.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Delete(p.Ctx, pvc.ObjectMeta.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &pvc.ObjectMeta.UID},
+	})
+	if err != nil {
+		if errors.IsNotFound(err) || errors.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+	p.Recorder.Event(pvc, corev1.EventTypeNormal, PVCSwept, fmt.Sprintf(MessagePVCSwept, podName, podUID, orphanedAt))
+	return nil
+}
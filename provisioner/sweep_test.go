@@ -0,0 +1,89 @@
+package provisioner
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPVCPod(t *testing.T) {
+	controllerRef := func(kind, name string, uid types.UID) []metav1.OwnerReference {
+		isController := true
+		return []metav1.OwnerReference{{APIVersion: "v1", Kind: kind, Name: name, UID: uid, Controller: &isController}}
+	}
+	stamped := map[string]string{AnnotationPodName: "stamped", AnnotationPodUID: "stamped-uid"}
+
+	tests := []struct {
+		name     string
+		meta     metav1.ObjectMeta
+		wantName string
+		wantUID  types.UID
+		wantOK   bool
+	}{
+		{
+			name: "unmanaged",
+		},
+		{
+			name:     "owned by pod",
+			meta:     metav1.ObjectMeta{OwnerReferences: controllerRef("Pod", "build", "build-uid")},
+			wantName: "build",
+			wantUID:  "build-uid",
+			wantOK:   true,
+		},
+		{
+			name:     "owner reference wins over annotations",
+			meta:     metav1.ObjectMeta{OwnerReferences: controllerRef("Pod", "build", "build-uid"), Annotations: stamped},
+			wantName: "build",
+			wantUID:  "build-uid",
+			wantOK:   true,
+		},
+		{
+			name: "owned by controller",
+			meta: metav1.ObjectMeta{OwnerReferences: controllerRef("StatefulSet", "db", "db-uid"), Annotations: stamped},
+		},
+		{
+			name:     "owner reference lost",
+			meta:     metav1.ObjectMeta{Annotations: stamped},
+			wantName: "stamped",
+			wantUID:  "stamped-uid",
+			wantOK:   true,
+		},
+		{
+			name:     "non-controller owner ignored",
+			meta:     metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "config", UID: "config-uid"}}, Annotations: stamped},
+			wantName: "stamped",
+			wantUID:  "stamped-uid",
+			wantOK:   true,
+		},
+		{
+			name: "name without uid",
+			meta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationPodName: "stamped"}},
+		},
+		{
+			name: "uid without name",
+			meta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationPodUID: "stamped-uid"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, uid, ok := pvcPod(&corev1.PersistentVolumeClaim{ObjectMeta: test.meta})
+			if name != test.wantName || uid != test.wantUID || ok != test.wantOK {
+				t.Errorf("expected (%q, %q, %v), got (%q, %q, %v)", test.wantName, test.wantUID, test.wantOK, name, uid, ok)
+			}
+		})
+	}
+}
+
+func TestStampPod(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "build", UID: "build-uid"}}
+	pvc := &corev1.PersistentVolumeClaim{}
+
+	stampPod(pvc, pod)
+	name, uid, ok := pvcPod(pvc)
+	if name != "build" || uid != "build-uid" || !ok {
+		t.Errorf("expected stamped pod to be found, got (%q, %q, %v)", name, uid, ok)
+	}
+}
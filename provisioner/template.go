@@ -0,0 +1,136 @@
+package provisioner
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Pod annotations
+	AnnotationTemplateKey = "template"
+
+	TemplateGroup   = AnnotationBaseName
+	TemplateVersion = "v1alpha1"
+)
+
+var (
+	PVCTemplateResource = schema.GroupVersionResource{
+		Group:    TemplateGroup,
+		Version:  TemplateVersion,
+		Resource: "pvctemplates",
+	}
+	ClusterPVCTemplateResource = schema.GroupVersionResource{
+		Group:    TemplateGroup,
+		Version:  TemplateVersion,
+		Resource: "clusterpvctemplates",
+	}
+)
+
+// WithPVCTemplates lets pods reference PVCTemplate and ClusterPVCTemplate resources instead of inline PVC YAML.
+// Requires WithDynamicClient and the CRDs to be installed.
+func WithPVCTemplates() Option {
+	return func(p *Provisioner) {
+		p.pvcTemplates = true
+	}
+}
+
+func (p *Provisioner) setupTemplates() {
+	if p.DynamicClient == nil {
+		klog.Warning("PVC templates are enabled, but there is no dynamic client - templates will not be resolved")
+		return
+	}
+
+	p.ClusterTemplateInformerFactory = dynamicinformer.NewDynamicSharedInformerFactory(p.DynamicClient, time.Second*30)
+	clusterTemplates := p.ClusterTemplateInformerFactory.ForResource(ClusterPVCTemplateResource)
+	p.ClusterTemplatesLister = clusterTemplates.Lister()
+	p.TemplatesSynced = []cache.InformerSynced{clusterTemplates.Informer().HasSynced}
+
+	// PVCTemplates are watched in the same namespaces as pods, including ones added by -namespace-selector
+	p.NamespaceInformers.AddSetup(func(namespace string, factory kubeinformers.SharedInformerFactory) []cache.InformerSynced {
+		return []cache.InformerSynced{p.templateInformer(namespace, factory).HasSynced}
+	})
+}
+
+// templateInformer returns the PVCTemplate informer of a namespace factory, so it is started and stopped with the namespace.
+// Factory keys informers by object type, PVCTemplate is the only unstructured one there.
+func (p *Provisioner) templateInformer(namespace string, factory kubeinformers.SharedInformerFactory) cache.SharedIndexInformer {
+	return factory.InformerFor(&unstructured.Unstructured{}, func(_ kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return dynamicinformer.NewFilteredDynamicInformer(
+			p.DynamicClient,
+			PVCTemplateResource,
+			namespace,
+			resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+			nil,
+		).Informer()
+	})
+}
+
+// templatesLister returns a lister of PVCTemplates in the namespace, empty if the namespace is not watched.
+func (p *Provisioner) templatesLister(namespace string) cache.GenericNamespaceLister {
+	factory := p.NamespaceInformers.Factory(namespace)
+	if factory == nil {
+		return cache.NewGenericLister(emptyIndexer, PVCTemplateResource.GroupResource()).ByNamespace(namespace)
+	}
+	// Informer was registered by the namespace setup, namespace only matters when it is created
+	informer := p.templateInformer(namespace, factory)
+	return cache.NewGenericLister(informer.GetIndexer(), PVCTemplateResource.GroupResource()).ByNamespace(namespace)
+}
+
+func (p *Provisioner) startTemplates(stopCh <-chan struct{}) {
+	if p.ClusterTemplateInformerFactory == nil {
+		return
+	}
+	p.ClusterTemplateInformerFactory.Start(stopCh)
+}
+
+// templatePVCYaml resolves a template by name and returns its PVC as YAML, so it is rendered just like an inline one.
+// A PVCTemplate in the pod namespace takes precedence over a ClusterPVCTemplate.
+func (p *Provisioner) templatePVCYaml(pod *corev1.Pod, name string) (string, error) {
+	if p.ClusterTemplatesLister == nil {
+		return "", fmt.Errorf("PVC templates are not enabled")
+	}
+
+	obj, err := p.templatesLister(pod.ObjectMeta.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		obj, err = p.ClusterTemplatesLister.Get(name)
+	}
+	if errors.IsNotFound(err) {
+		return "", fmt.Errorf("neither PVCTemplate %s/%s nor ClusterPVCTemplate %s found", pod.ObjectMeta.Namespace, name, name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", fmt.Errorf("expected unstructured template, got: %T", obj)
+	}
+	template, found, err := unstructured.NestedMap(u.Object, "spec", "template")
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("template %s has no spec.template", name)
+	}
+	template["apiVersion"] = "v1"
+	template["kind"] = "PersistentVolumeClaim"
+
+	pvcYaml, err := yaml.Marshal(template)
+	if err != nil {
+		return "", fmt.Errorf("template %s: %w", name, err)
+	}
+	klog.V(6).Infof("Resolved template %s for pod %s/%s", name, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+	return string(pvcYaml), nil
+}
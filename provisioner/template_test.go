@@ -0,0 +1,84 @@
+package provisioner
+
+import (
+	"strings"
+	"testing"
+
+	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func templateTestObject(kind, namespace, storageClass string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": TemplateGroup + "/" + TemplateVersion,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": "maven-cache"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{"storageClassName": storageClass},
+			},
+		},
+	}}
+	if namespace != "" {
+		u.SetNamespace(namespace)
+	}
+	return u
+}
+
+func TestTemplatePVCYaml(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			PVCTemplateResource:        "PVCTemplateList",
+			ClusterPVCTemplateResource: "ClusterPVCTemplateList",
+		},
+		templateTestObject("PVCTemplate", "team-a", "team-a"),
+		templateTestObject("PVCTemplate", "unwatched", "unwatched"),
+		templateTestObject("ClusterPVCTemplate", "", "cluster"),
+	)
+
+	p := &Provisioner{
+		DynamicClient:      dynamicClient,
+		NamespaceInformers: controller.NewNamespaceInformers(fake.NewSimpleClientset(), 0, []string{"team-a", "team-b"}, nil),
+	}
+	p.setupTemplates()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	p.NamespaceInformers.Start(stopCh)
+	p.startTemplates(stopCh)
+	synced := append([]cache.InformerSynced{p.NamespaceInformers.HasSynced}, p.TemplatesSynced...)
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		t.Fatal("failed to sync templates")
+	}
+
+	tests := []struct {
+		namespace string
+		want      string
+	}{
+		{namespace: "team-a", want: "storageClassName: team-a"},
+		{namespace: "team-b", want: "storageClassName: cluster"},
+		// Templates of namespaces Provisioner doesn't watch are not seen
+		{namespace: "unwatched", want: "storageClassName: cluster"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.namespace, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "build", Namespace: test.namespace}}
+			got, err := p.templatePVCYaml(pod, "maven-cache")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !strings.Contains(got, test.want) {
+				t.Errorf("expected %q in:\n%s", test.want, got)
+			}
+		})
+	}
+}
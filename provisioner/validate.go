@@ -0,0 +1,67 @@
+package provisioner
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	MessagePVCRejected = "'%s' PVC %s rejected, not retrying: %s"
+	ErrPVCRejected     = "ErrPVCRejected"
+)
+
+// describeError returns the API status reason and message of the error, if it has any.
+func describeError(err error) string {
+	if status, ok := err.(errors.APIStatus); ok {
+		return fmt.Sprintf("%s: %s", status.Status().Reason, status.Status().Message)
+	}
+	return err.Error()
+}
+
+// isPermanent returns true if the API server rejected the PVC in a way a retry would not fix, i.e. invalid spec.
+// Forbidden is transient, as exceeded quota or a denying admission webhook may change their mind.
+func isPermanent(err error) bool {
+	switch errors.ReasonForError(err) {
+	case metav1.StatusReasonInvalid, metav1.StatusReasonBadRequest, metav1.StatusReasonRequestEntityTooLarge,
+		metav1.StatusReasonUnsupportedMediaType, metav1.StatusReasonNotAcceptable:
+		return true
+	default:
+		return false
+	}
+}
+
+// createPVC validates the PVC with a server-side dry run and then creates it.
+// Returns false if the PVC was not created, an error is only returned if it is worth retrying.
+func (p *Provisioner) createPVC(pod *corev1.Pod, volumeName string, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	pvcs := p.KubeClientSet.CoreV1().PersistentVolumeClaims(pod.ObjectMeta.Namespace)
+
+	for _, dryRun := range [][]string{{metav1.DryRunAll}, nil} {
+		_, err := pvcs.Create(p.Ctx, pvc, metav1.CreateOptions{DryRun: dryRun})
+		if err == nil {
+			continue
+		}
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+
+		if isPermanent(err) {
+			klog.V(4).Infof("PVC %s/%s rejected (dry run: %v): %s", pod.ObjectMeta.Namespace, pvc.ObjectMeta.Name, dryRun != nil, err)
+			p.Recorder.Event(pod, corev1.EventTypeWarning, ErrPVCRejected, fmt.Sprintf(MessagePVCRejected, volumeName, pvc.ObjectMeta.Name, describeError(err)))
+			// Checked out PV would otherwise be held until the pod is gone
+			if pvc.Spec.VolumeName != "" {
+				if err := p.releaseCheckout(pod, pvc); err != nil {
+					return false, err
+				}
+			}
+			return false, nil
+		}
+		p.Recorder.Event(pod, corev1.EventTypeWarning, ErrPVCProvisionFailed, fmt.Sprintf(MessagePVCProvisionFailed, volumeName, pvc.ObjectMeta.Name, describeError(err)))
+		return false, err
+	}
+
+	return true, nil
+}
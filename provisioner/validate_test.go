@@ -0,0 +1,80 @@
+package provisioner
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestIsPermanent(t *testing.T) {
+	pvcs := schema.GroupResource{Resource: "persistentvolumeclaims"}
+	pvcKind := corev1.SchemeGroupVersion.WithKind("PersistentVolumeClaim").GroupKind()
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "invalid",
+			err:  errors.NewInvalid(pvcKind, "cache", field.ErrorList{field.Required(field.NewPath("spec", "resources"), "")}),
+			want: true,
+		},
+		{
+			name: "bad request",
+			err:  errors.NewBadRequest("malformed"),
+			want: true,
+		},
+		{
+			name: "request entity too large",
+			err:  errors.NewRequestEntityTooLargeError("too large"),
+			want: true,
+		},
+		{
+			name: "exceeded quota",
+			err:  errors.NewForbidden(pvcs, "cache", fmt.Errorf("exceeded quota: storage, requested: requests.storage=10Gi")),
+		},
+		{
+			name: "denied by admission",
+			err:  errors.NewForbidden(pvcs, "cache", fmt.Errorf("admission webhook \"pvc.example.com\" denied the request")),
+		},
+		{
+			name: "conflict",
+			err:  errors.NewConflict(pvcs, "cache", fmt.Errorf("changed")),
+		},
+		{
+			name: "server timeout",
+			err:  errors.NewServerTimeout(pvcs, "create", 1),
+		},
+		{
+			name: "internal error",
+			err:  errors.NewInternalError(fmt.Errorf("boom")),
+		},
+		{
+			name: "not an API error",
+			err:  fmt.Errorf("connection refused"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isPermanent(test.err); got != test.want {
+				t.Errorf("expected %v for %s, got %v", test.want, test.err, got)
+			}
+		})
+	}
+}
+
+func TestDescribeError(t *testing.T) {
+	err := errors.NewBadRequest("malformed")
+	if got, want := describeError(err), "BadRequest: malformed"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := describeError(fmt.Errorf("connection refused")), "connection refused"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,198 @@
+package provisioner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Pod annotations
+	AnnotationVolumesKey = "volumes"
+	AnnotationVolumes    = AnnotationBaseName + "/" + AnnotationVolumesKey
+
+	MessageInvalidVolumes = "'%s' invalid: %s"
+	ErrInvalidVolumes     = "ErrInvalidVolumes"
+)
+
+// volumeOptions are per-volume options, set in VolumeRequest.Options or as `<volume>.<option>` legacy annotations.
+var volumeOptions = []string{
+	AnnotationModeKey,
+	AnnotationReleaseOnFinishKey,
+	AnnotationOwnerKey,
+	AnnotationStorageClassesKey,
+	AnnotationBindTimeoutKey,
+}
+
+// VolumeRequest is a single entry of the volumes annotation:
+//
+//	dynamic-pvc-provisioner.kubernetes.io/volumes: |-
+//	  - volume: cache
+//	    template: maven-cache
+//	    options:
+//	      mode: clone
+type VolumeRequest struct {
+	Volume   string            `json:"volume"`
+	PVC      string            `json:"pvc,omitempty"`
+	Template string            `json:"template,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+
+	// claimName is the pod volume claim, empty if the pod has no such volume
+	claimName string
+}
+
+func (r *VolumeRequest) validate() error {
+	if r.Volume == "" {
+		return fmt.Errorf("volume must be set")
+	}
+	if (r.PVC == "") == (r.Template == "") {
+		return fmt.Errorf("volume %s: exactly one of pvc and template must be set", r.Volume)
+	}
+	for key := range r.Options {
+		known := false
+		for _, option := range volumeOptions {
+			if key == option {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("volume %s: unknown option %q", r.Volume, key)
+		}
+	}
+	return nil
+}
+
+type volumeProblem struct {
+	reason  string
+	message string
+}
+
+// parseVolumeRequests collects volume requests from both the volumes annotation and the legacy per-volume annotations.
+// Invalid requests are left out and returned as problems.
+func parseVolumeRequests(pod *corev1.Pod) (map[string]*VolumeRequest, []volumeProblem) {
+	annotations := pod.ObjectMeta.Annotations
+	requests := map[string]*VolumeRequest{}
+	problems := []volumeProblem{}
+
+	legacy, legacyProblems := parseLegacyVolumeRequests(annotations)
+	problems = append(problems, legacyProblems...)
+
+	value, ok := annotations[AnnotationVolumes]
+	if !ok {
+		return legacy, problems
+	}
+
+	entries := []*VolumeRequest{}
+	// YAML is a superset of JSON, so it reads both formats
+	if err := yaml.UnmarshalStrict([]byte(value), &entries); err != nil {
+		problems = append(problems, volumeProblem{ErrInvalidVolumes, fmt.Sprintf(MessageInvalidVolumes, AnnotationVolumes, err)})
+		return legacy, problems
+	}
+
+	seen := map[string]struct{}{}
+	conflicts := map[string]struct{}{}
+	for i, entry := range entries {
+		if entry == nil {
+			problems = append(problems, volumeProblem{ErrInvalidVolumes, fmt.Sprintf(MessageInvalidVolumes, AnnotationVolumes, fmt.Sprintf("entry %d is empty", i))})
+			continue
+		}
+		if err := entry.validate(); err != nil {
+			problems = append(problems, volumeProblem{ErrInvalidVolumes, fmt.Sprintf(MessageInvalidVolumes, AnnotationVolumes, fmt.Sprintf("entry %d: %s", i, err))})
+			continue
+		}
+		if _, ok := seen[entry.Volume]; ok {
+			problems = append(problems, volumeProblem{ErrInvalidVolumes, fmt.Sprintf(MessageInvalidVolumes, AnnotationVolumes, fmt.Sprintf("entry %d: volume %s is listed more than once", i, entry.Volume))})
+			continue
+		}
+		seen[entry.Volume] = struct{}{}
+		if _, ok := legacy[entry.Volume]; ok {
+			conflicts[entry.Volume] = struct{}{}
+			continue
+		}
+		if entry.Options == nil {
+			entry.Options = map[string]string{}
+		}
+		requests[entry.Volume] = entry
+	}
+
+	for volume, request := range legacy {
+		if _, ok := conflicts[volume]; ok {
+			problems = append(problems, volumeProblem{ErrInvalidVolumes, fmt.Sprintf(MessageInvalidVolumes, AnnotationVolumes,
+				fmt.Sprintf("volume %s is also requested by '%s/%s.%s', use only one format", volume, AnnotationBaseName, volume, AnnotationEnabledKey))})
+			continue
+		}
+		requests[volume] = request
+	}
+
+	return requests, problems
+}
+
+// parseLegacyVolumeRequests reads `<volume>.enabled`, `<volume>.pvc` or `<volume>.template` and option annotations.
+func parseLegacyVolumeRequests(annotations map[string]string) (map[string]*VolumeRequest, []volumeProblem) {
+	requests := map[string]*VolumeRequest{}
+	problems := []volumeProblem{}
+
+	for key, value := range annotations {
+		keyParts := strings.Split(key, "/")
+		klog.V(6).Info(fmt.Sprintf("keyParts: %s", keyParts))
+		if len(keyParts) != 2 || keyParts[0] != AnnotationBaseName {
+			continue
+		}
+		keySubParts := strings.Split(keyParts[1], ".")
+		klog.V(6).Info(fmt.Sprintf("keySubParts: %s", keySubParts))
+		if len(keySubParts) != 2 || keySubParts[1] != AnnotationEnabledKey {
+			continue
+		}
+		requestedVolumeName := keySubParts[0]
+
+		enabled, err := strconv.ParseBool(value)
+		if err != nil || !enabled {
+			klog.V(5).Info(fmt.Sprintf("'%s: %v', skip", key, value))
+			continue
+		}
+
+		pvcKey := fmt.Sprintf("%s/%s.%s", AnnotationBaseName, requestedVolumeName, AnnotationPVCKey)
+		templateKey := fmt.Sprintf("%s/%s.%s", AnnotationBaseName, requestedVolumeName, AnnotationTemplateKey)
+		pvc, hasPVC := annotations[pvcKey]
+		template, hasTemplate := annotations[templateKey]
+		if !hasPVC && !hasTemplate {
+			problems = append(problems, volumeProblem{ErrMissingPVC, fmt.Sprintf(MessageMissingPVC, pvcKey)})
+			continue
+		}
+		if hasPVC && hasTemplate {
+			problems = append(problems, volumeProblem{ErrInvalidPVC, fmt.Sprintf(MessageInvalidPVC, requestedVolumeName,
+				fmt.Sprintf("only one of '%s' and '%s' can be set", pvcKey, templateKey))})
+			continue
+		}
+
+		request := &VolumeRequest{
+			Volume:   requestedVolumeName,
+			PVC:      pvc,
+			Template: template,
+			Options:  map[string]string{},
+		}
+		for _, option := range volumeOptions {
+			if value, ok := annotations[fmt.Sprintf("%s/%s.%s", AnnotationBaseName, requestedVolumeName, option)]; ok {
+				request.Options[option] = value
+			}
+		}
+		requests[requestedVolumeName] = request
+	}
+
+	return requests, problems
+}
+
+// volumeRequests returns valid volume requests of the pod, reporting the invalid ones as pod events.
+func (p *Provisioner) volumeRequests(pod *corev1.Pod) map[string]*VolumeRequest {
+	requests, problems := parseVolumeRequests(pod)
+	sort.Slice(problems, func(i, j int) bool { return problems[i].message < problems[j].message })
+	for _, problem := range problems {
+		p.Recorder.Event(pod, corev1.EventTypeWarning, problem.reason, problem.message)
+	}
+	return requests
+}
@@ -0,0 +1,198 @@
+package provisioner
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func volumesTestPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+	}
+}
+
+func legacyKey(volume, key string) string {
+	return AnnotationBaseName + "/" + volume + "." + key
+}
+
+func TestParseVolumeRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]*VolumeRequest
+		problems    []string
+	}{
+		{
+			name: "no annotations",
+			want: map[string]*VolumeRequest{},
+		},
+		{
+			name: "volumes annotation",
+			annotations: map[string]string{
+				AnnotationVolumes: `
+- volume: cache
+  template: maven-cache
+  options:
+    mode: clone
+- volume: scratch
+  pvc: |
+    spec:
+      accessModes: [ReadWriteOnce]
+`,
+			},
+			want: map[string]*VolumeRequest{
+				"cache":   {Volume: "cache", Template: "maven-cache", Options: map[string]string{AnnotationModeKey: ModeClone}},
+				"scratch": {Volume: "scratch", PVC: "spec:\n  accessModes: [ReadWriteOnce]\n", Options: map[string]string{}},
+			},
+		},
+		{
+			name: "volumes annotation as JSON",
+			annotations: map[string]string{
+				AnnotationVolumes: `[{"volume": "cache", "template": "maven-cache"}]`,
+			},
+			want: map[string]*VolumeRequest{
+				"cache": {Volume: "cache", Template: "maven-cache", Options: map[string]string{}},
+			},
+		},
+		{
+			name: "legacy annotations",
+			annotations: map[string]string{
+				legacyKey("cache", AnnotationEnabledKey):  "true",
+				legacyKey("cache", AnnotationTemplateKey): "maven-cache",
+				legacyKey("cache", AnnotationModeKey):     ModeClone,
+				legacyKey("off", AnnotationEnabledKey):    "false",
+				legacyKey("off", AnnotationPVCKey):        "spec: {}",
+			},
+			want: map[string]*VolumeRequest{
+				"cache": {Volume: "cache", Template: "maven-cache", Options: map[string]string{AnnotationModeKey: ModeClone}},
+			},
+		},
+		{
+			name: "legacy without pvc or template",
+			annotations: map[string]string{
+				legacyKey("cache", AnnotationEnabledKey): "true",
+			},
+			want:     map[string]*VolumeRequest{},
+			problems: []string{ErrMissingPVC},
+		},
+		{
+			name: "legacy with both pvc and template",
+			annotations: map[string]string{
+				legacyKey("cache", AnnotationEnabledKey):  "true",
+				legacyKey("cache", AnnotationPVCKey):      "spec: {}",
+				legacyKey("cache", AnnotationTemplateKey): "maven-cache",
+			},
+			want:     map[string]*VolumeRequest{},
+			problems: []string{ErrInvalidPVC},
+		},
+		{
+			name: "both formats merged",
+			annotations: map[string]string{
+				AnnotationVolumes:                          "- volume: cache\n  template: maven-cache\n",
+				legacyKey("scratch", AnnotationEnabledKey): "true",
+				legacyKey("scratch", AnnotationPVCKey):     "spec: {}",
+			},
+			want: map[string]*VolumeRequest{
+				"cache":   {Volume: "cache", Template: "maven-cache", Options: map[string]string{}},
+				"scratch": {Volume: "scratch", PVC: "spec: {}", Options: map[string]string{}},
+			},
+		},
+		{
+			name: "invalid YAML",
+			annotations: map[string]string{
+				AnnotationVolumes: "- volume: [",
+			},
+			want:     map[string]*VolumeRequest{},
+			problems: []string{ErrInvalidVolumes},
+		},
+		{
+			name: "unknown field",
+			annotations: map[string]string{
+				AnnotationVolumes: "- volume: cache\n  template: maven-cache\n  mode: clone\n",
+			},
+			want:     map[string]*VolumeRequest{},
+			problems: []string{ErrInvalidVolumes},
+		},
+		{
+			name: "invalid entries",
+			annotations: map[string]string{
+				AnnotationVolumes: `
+- null
+- template: maven-cache
+- volume: both
+  pvc: "spec: {}"
+  template: maven-cache
+- volume: neither
+- volume: option
+  template: maven-cache
+  options:
+    color: blue
+- volume: cache
+  template: maven-cache
+`,
+			},
+			want: map[string]*VolumeRequest{
+				"cache": {Volume: "cache", Template: "maven-cache", Options: map[string]string{}},
+			},
+			problems: []string{ErrInvalidVolumes, ErrInvalidVolumes, ErrInvalidVolumes, ErrInvalidVolumes, ErrInvalidVolumes},
+		},
+		{
+			name: "listed more than once",
+			annotations: map[string]string{
+				AnnotationVolumes: "- volume: cache\n  template: maven-cache\n- volume: cache\n  template: other-cache\n",
+			},
+			want: map[string]*VolumeRequest{
+				"cache": {Volume: "cache", Template: "maven-cache", Options: map[string]string{}},
+			},
+			problems: []string{ErrInvalidVolumes},
+		},
+		{
+			name: "conflicts with legacy",
+			annotations: map[string]string{
+				AnnotationVolumes:                        "- volume: cache\n  template: maven-cache\n",
+				legacyKey("cache", AnnotationEnabledKey): "true",
+				legacyKey("cache", AnnotationPVCKey):     "spec: {}",
+			},
+			want:     map[string]*VolumeRequest{},
+			problems: []string{ErrInvalidVolumes},
+		},
+		{
+			name: "conflicts with legacy and listed more than once",
+			annotations: map[string]string{
+				AnnotationVolumes:                        "- volume: cache\n  template: maven-cache\n- volume: cache\n  template: other-cache\n",
+				legacyKey("cache", AnnotationEnabledKey): "true",
+				legacyKey("cache", AnnotationPVCKey):     "spec: {}",
+			},
+			want:     map[string]*VolumeRequest{},
+			problems: []string{ErrInvalidVolumes, ErrInvalidVolumes},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests, problems := parseVolumeRequests(volumesTestPod(test.annotations))
+			if !reflect.DeepEqual(requests, test.want) {
+				t.Errorf("expected requests %v, got %v", test.want, requests)
+			}
+
+			reasons := []string{}
+			for _, problem := range problems {
+				reasons = append(reasons, problem.reason)
+			}
+			sort.Strings(reasons)
+			want := append([]string{}, test.problems...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(reasons, want) {
+				t.Errorf("expected problems %v, got %v", want, problems)
+			}
+		})
+	}
+}
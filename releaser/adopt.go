@@ -0,0 +1,221 @@
+package releaser
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// PV annotations
+	AnnotationAdoptedAtKey                = "adopted-at"
+	AnnotationAdoptedAt                   = AnnotationBaseName + "/" + AnnotationAdoptedAtKey
+	AnnotationAdoptedFromStorageClassKey  = "adopted-from-storage-class"
+	AnnotationAdoptedFromStorageClass     = AnnotationBaseName + "/" + AnnotationAdoptedFromStorageClassKey
+	AnnotationMigratedAtKey               = "migrated-at"
+	AnnotationMigratedAt                  = AnnotationBaseName + "/" + AnnotationMigratedAtKey
+	AnnotationMigratedFromStorageClassKey = "migrated-from-storage-class"
+	AnnotationMigratedFromStorageClass    = AnnotationBaseName + "/" + AnnotationMigratedFromStorageClassKey
+)
+
+// Adopt is a command that pulls PVs matching a selector into a managed pool.
+//
+//	reclaimable-pv-releaser -controller-id=... adopt -selector=app=cache -storage-class=pool [-dry-run]
+func Adopt(
+	ctx context.Context,
+	_ *rest.Config,
+	client clientset.Interface,
+	controllerId string,
+	args []string,
+) error {
+	flags := flag.NewFlagSet("adopt", flag.ContinueOnError)
+	selector := flags.String("selector", "", "label selector of PVs to adopt")
+	storageClass := flags.String("storage-class", "", "Storage Class of the pool to adopt PVs into")
+	dryRun := flags.Bool("dry-run", false, "only print what would be done")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *selector == "" || *storageClass == "" {
+		return fmt.Errorf("-selector and -storage-class are required")
+	}
+
+	if err := checkPoolSC(ctx, client, controllerId, *storageClass); err != nil {
+		return err
+	}
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{LabelSelector: *selector})
+	if err != nil {
+		return err
+	}
+
+	m := &mover{
+		client:           client,
+		dryRun:           *dryRun,
+		verb:             "adopt",
+		done:             "adopted",
+		annotationAt:     AnnotationAdoptedAt,
+		annotationFromSC: AnnotationAdoptedFromStorageClass,
+		requireRetain:    true,
+	}
+	for i := range pvs.Items {
+		m.move(ctx, &pvs.Items[i], *storageClass)
+	}
+	return m.result()
+}
+
+// Migrate is a command that moves Available PVs from one managed pool to another.
+//
+//	reclaimable-pv-releaser -controller-id=... migrate -from=gp2-pool -to=gp3-pool [-dry-run]
+func Migrate(
+	ctx context.Context,
+	_ *rest.Config,
+	client clientset.Interface,
+	controllerId string,
+	args []string,
+) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.String("from", "", "Storage Class of the pool to migrate PVs from")
+	to := flags.String("to", "", "Storage Class of the pool to migrate PVs to")
+	dryRun := flags.Bool("dry-run", false, "only print what would be done")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return fmt.Errorf("-from and -to are required")
+	}
+	if *from == *to {
+		return fmt.Errorf("-from and -to must be different")
+	}
+
+	for _, name := range []string{*from, *to} {
+		if err := checkPoolSC(ctx, client, controllerId, name); err != nil {
+			return err
+		}
+	}
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	m := &mover{
+		client:           client,
+		dryRun:           *dryRun,
+		verb:             "migrate",
+		done:             "migrated",
+		annotationAt:     AnnotationMigratedAt,
+		annotationFromSC: AnnotationMigratedFromStorageClass,
+		requireAvailable: true,
+	}
+	for i := range pvs.Items {
+		if pvs.Items[i].Spec.StorageClassName != *from {
+			continue
+		}
+		m.move(ctx, &pvs.Items[i], *to)
+	}
+	return m.result()
+}
+
+// checkPoolSC makes sure the Storage Class exists and is managed by this controller.
+func checkPoolSC(ctx context.Context, client clientset.Interface, controllerId, name string) error {
+	sc, err := client.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if sc.ObjectMeta.Annotations[AnnotationControllerId] != controllerId {
+		return fmt.Errorf("SC %s is not annotated with %s=%s", name, AnnotationControllerId, controllerId)
+	}
+	return nil
+}
+
+// mover rewrites spec.storageClassName of PVs and records where they came from.
+type mover struct {
+	client clientset.Interface
+	dryRun bool
+	verb   string
+	done   string
+
+	annotationAt     string
+	annotationFromSC string
+
+	// requireAvailable refuses Released PVs too, not only Bound
+	requireAvailable bool
+	// requireRetain refuses PVs that would be deleted once released
+	requireRetain bool
+
+	moved   int
+	refused int
+	failed  int
+}
+
+func (m *mover) move(ctx context.Context, pv *corev1.PersistentVolume, storageClass string) {
+	name := pv.ObjectMeta.Name
+	if pv.Spec.StorageClassName == storageClass {
+		klog.V(5).Infof("PV %s is already in SC %s, skip", name, storageClass)
+		return
+	}
+	if reason := m.refuse(pv); reason != "" {
+		fmt.Printf("refused to %s PV %s: %s\n", m.verb, name, reason)
+		m.refused++
+		return
+	}
+	if m.dryRun {
+		fmt.Printf("would %s PV %s from SC %q to SC %q\n", m.verb, name, pv.Spec.StorageClassName, storageClass)
+		m.moved++
+		return
+	}
+
+	pvCopy := pv.DeepCopy()
+	if pvCopy.ObjectMeta.Annotations == nil {
+		pvCopy.ObjectMeta.Annotations = make(map[string]string)
+	}
+	pvCopy.ObjectMeta.Annotations[m.annotationAt] = time.Now().UTC().Format(time.RFC3339)
+	pvCopy.ObjectMeta.Annotations[m.annotationFromSC] = pv.Spec.StorageClassName
+	pvCopy.Spec.StorageClassName = storageClass
+	if _, err := m.client.CoreV1().PersistentVolumes().Update(ctx, pvCopy, metav1.UpdateOptions{}); err != nil {
+		if errors.IsConflict(err) {
+			fmt.Printf("refused to %s PV %s: it was changed, try again\n", m.verb, name)
+			m.refused++
+			return
+		}
+		klog.Errorf("Failed to %s PV %s: %s", m.verb, name, err)
+		m.failed++
+		return
+	}
+	fmt.Printf("%s PV %s from SC %q to SC %q\n", m.done, name, pv.Spec.StorageClassName, storageClass)
+	m.moved++
+}
+
+func (m *mover) refuse(pv *corev1.PersistentVolume) string {
+	switch {
+	case pv.Status.Phase == corev1.VolumeBound:
+		return "PV is Bound"
+	case m.requireAvailable && pv.Status.Phase != corev1.VolumeAvailable:
+		return fmt.Sprintf("PV is %s", pv.Status.Phase)
+	case m.requireRetain && pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain:
+		return fmt.Sprintf("PV reclaim policy is %s, it would not survive a release", pv.Spec.PersistentVolumeReclaimPolicy)
+	case pv.ObjectMeta.DeletionTimestamp != nil:
+		return "PV is being deleted"
+	}
+	return ""
+}
+
+func (m *mover) result() error {
+	if m.dryRun {
+		fmt.Printf("dry-run: %d PVs would be %s, %d refused\n", m.moved, m.done, m.refused)
+		return nil
+	}
+	fmt.Printf("%d PVs %s, %d refused, %d failed\n", m.moved, m.done, m.refused, m.failed)
+	if m.failed > 0 {
+		return fmt.Errorf("failed to %s %d PVs", m.verb, m.failed)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package releaser
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func adoptTestPV(name, storageClass string, phase corev1.PersistentVolumePhase, policy corev1.PersistentVolumeReclaimPolicy) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"app": "cache"}},
+		Spec: corev1.PersistentVolumeSpec{
+			StorageClassName:              storageClass,
+			PersistentVolumeReclaimPolicy: policy,
+		},
+		Status: corev1.PersistentVolumeStatus{Phase: phase},
+	}
+}
+
+func adoptTestClient() *fake.Clientset {
+	poolSC := func(name, controllerId string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{AnnotationControllerId: controllerId},
+		}}
+	}
+	unlabeled := adoptTestPV("unlabeled", "standard", corev1.VolumeAvailable, corev1.PersistentVolumeReclaimRetain)
+	unlabeled.ObjectMeta.Labels = nil
+
+	return fake.NewSimpleClientset(
+		poolSC("pool", "test"),
+		poolSC("gp3-pool", "test"),
+		poolSC("foreign", "other"),
+		adoptTestPV("available", "standard", corev1.VolumeAvailable, corev1.PersistentVolumeReclaimRetain),
+		adoptTestPV("released", "standard", corev1.VolumeReleased, corev1.PersistentVolumeReclaimRetain),
+		adoptTestPV("bound", "standard", corev1.VolumeBound, corev1.PersistentVolumeReclaimRetain),
+		adoptTestPV("delete", "standard", corev1.VolumeAvailable, corev1.PersistentVolumeReclaimDelete),
+		adoptTestPV("pooled-available", "pool", corev1.VolumeAvailable, corev1.PersistentVolumeReclaimRetain),
+		adoptTestPV("pooled-released", "pool", corev1.VolumeReleased, corev1.PersistentVolumeReclaimRetain),
+		unlabeled,
+	)
+}
+
+// storageClasses returns the Storage Class of every PV.
+func storageClasses(t *testing.T, client *fake.Clientset) map[string]string {
+	t.Helper()
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]string{}
+	for _, pv := range pvs.Items {
+		result[pv.ObjectMeta.Name] = pv.Spec.StorageClassName
+	}
+	return result
+}
+
+func TestAdopt(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		// moved PVs, the rest are expected to keep their Storage Class
+		want map[string]string
+	}{
+		{
+			name:    "missing selector",
+			args:    []string{"-storage-class=pool"},
+			wantErr: true,
+		},
+		{
+			name:    "not a pool",
+			args:    []string{"-selector=app=cache", "-storage-class=foreign"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown pool",
+			args:    []string{"-selector=app=cache", "-storage-class=missing"},
+			wantErr: true,
+		},
+		{
+			name: "dry run",
+			args: []string{"-selector=app=cache", "-storage-class=pool", "-dry-run"},
+		},
+		{
+			name: "adopts unbound retained PVs",
+			args: []string{"-selector=app=cache", "-storage-class=pool"},
+			want: map[string]string{"available": "pool", "released": "pool"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := adoptTestClient()
+			want := storageClasses(t, client)
+			for name, storageClass := range test.want {
+				want[name] = storageClass
+			}
+
+			err := Adopt(context.Background(), nil, client, "test", test.args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			got := storageClasses(t, client)
+			for name, storageClass := range want {
+				if got[name] != storageClass {
+					t.Errorf("expected PV %s in SC %q, got %q", name, storageClass, got[name])
+				}
+			}
+
+			for name := range test.want {
+				pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pv.ObjectMeta.Annotations[AnnotationAdoptedFromStorageClass] != "standard" || pv.ObjectMeta.Annotations[AnnotationAdoptedAt] == "" {
+					t.Errorf("expected PV %s to record adoption, got %v", name, pv.ObjectMeta.Annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		// moved PVs, the rest are expected to keep their Storage Class
+		want map[string]string
+	}{
+		{
+			name:    "missing to",
+			args:    []string{"-from=pool"},
+			wantErr: true,
+		},
+		{
+			name:    "same pool",
+			args:    []string{"-from=pool", "-to=pool"},
+			wantErr: true,
+		},
+		{
+			name:    "not a pool",
+			args:    []string{"-from=standard", "-to=pool"},
+			wantErr: true,
+		},
+		{
+			name: "dry run",
+			args: []string{"-from=pool", "-to=gp3-pool", "-dry-run"},
+		},
+		{
+			name: "migrates Available PVs only",
+			args: []string{"-from=pool", "-to=gp3-pool"},
+			want: map[string]string{"pooled-available": "gp3-pool"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := adoptTestClient()
+			want := storageClasses(t, client)
+			for name, storageClass := range test.want {
+				want[name] = storageClass
+			}
+
+			err := Migrate(context.Background(), nil, client, "test", test.args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			got := storageClasses(t, client)
+			for name, storageClass := range want {
+				if got[name] != storageClass {
+					t.Errorf("expected PV %s in SC %q, got %q", name, storageClass, got[name])
+				}
+			}
+
+			for name := range test.want {
+				pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pv.ObjectMeta.Annotations[AnnotationMigratedFromStorageClass] != "pool" || pv.ObjectMeta.Annotations[AnnotationMigratedAt] == "" {
+					t.Errorf("expected PV %s to record migration, got %v", name, pv.ObjectMeta.Annotations)
+				}
+			}
+		})
+	}
+}
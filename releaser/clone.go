@@ -0,0 +1,87 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Storage Class annotations
+	AnnotationCloneSourceNamespaceKey = "clone-source-namespace"
+	AnnotationCloneSourceNamespace    = AnnotationBaseName + "/" + AnnotationCloneSourceNamespaceKey
+
+	// HelperClone is a LabelHelper value of PVCs that can be used as a clone source
+	HelperClone = pool.HelperClone
+
+	CloneSource          = "CloneSource"
+	MessagePVCloneSource = "PV is now a clone source via %s/%s"
+)
+
+// isCloneSource returns true if the PV is claimed by its own clone source helper PVC.
+func isCloneSource(pv *corev1.PersistentVolume, namespace string) bool {
+	claimRef := pv.Spec.ClaimRef
+	return claimRef != nil && claimRef.Namespace == namespace && claimRef.Name == helperName(HelperClone, pv.ObjectMeta.Name)
+}
+
+// cloneSourcePolicy keeps the current clone source out of the pool.
+// It must go before any other built-in policies that may try to pin the PV.
+func (r *Releaser) cloneSourcePolicy(_ context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	namespace, ok := sc.ObjectMeta.Annotations[AnnotationCloneSourceNamespace]
+	if !ok || !isCloneSource(pv, namespace) {
+		return ActionContinue, ""
+	}
+	if pv.Status.Phase == corev1.VolumeBound {
+		return ActionSkip, "PV is a clone source"
+	}
+	// Helper PVC is gone - a newer clone source replaced this one, let it go back to the pool
+	return ActionContinue, ""
+}
+
+// clonePolicy makes the most recently Released PV a clone source for the Provisioner.
+// It pins the PV with a helper PVC in the clone source namespace and lets previous clone sources go.
+func (r *Releaser) clonePolicy(_ context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	namespace, ok := sc.ObjectMeta.Annotations[AnnotationCloneSourceNamespace]
+	if !ok || isCloneSource(pv, namespace) || pv.Status.Phase != corev1.VolumeReleased {
+		return ActionContinue, ""
+	}
+
+	pvc, err := r.pinPV(pv, sc, HelperClone, namespace)
+	if err != nil {
+		return ActionWait, fmt.Sprintf("failed to pin PV: %s", err)
+	}
+	r.Recorder.Event(pv, corev1.EventTypeNormal, CloneSource, fmt.Sprintf(MessagePVCloneSource, pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name))
+
+	pvcs := r.KubeClientSet.CoreV1().PersistentVolumeClaims(namespace)
+	list, err := pvcs.List(r.Ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			LabelManagedBy:    r.ControllerId,
+			LabelHelper:       HelperClone,
+			LabelStorageClass: sc.ObjectMeta.Name,
+		}).String(),
+	})
+	if err != nil {
+		klog.Warningf("Failed to list previous clone sources of SC %s: %s", sc.ObjectMeta.Name, err)
+		return ActionSkip, "PV is now a clone source"
+	}
+	for _, previous := range list.Items {
+		if previous.ObjectMeta.Name == pvc.ObjectMeta.Name || previous.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		// In-flight clones are protected by the CSI provisioner, the PVC will be gone once they are done
+		if err := pvcs.Delete(r.Ctx, previous.ObjectMeta.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			klog.Warningf("Failed to delete previous clone source %s/%s: %s", namespace, previous.ObjectMeta.Name, err)
+			continue
+		}
+		klog.V(4).Infof("Deleted previous clone source %s/%s of SC %s", namespace, previous.ObjectMeta.Name, sc.ObjectMeta.Name)
+	}
+
+	return ActionSkip, "PV is now a clone source"
+}
@@ -0,0 +1,178 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Storage Class annotations
+	AnnotationDrainKey = "drain"
+	AnnotationDrain    = AnnotationBaseName + "/" + AnnotationDrainKey
+
+	Draining          = "Draining"
+	MessageSCDraining = "drain in progress: %d PVs remaining, %d of them Bound"
+
+	DrainComplete          = "DrainComplete"
+	MessageSCDrainComplete = "drain complete"
+)
+
+func isDraining(sc *storagev1.StorageClass) bool {
+	drain, err := strconv.ParseBool(sc.ObjectMeta.Annotations[AnnotationDrain])
+	return err == nil && drain
+}
+
+// drainPolicy stops releasing PVs of a draining Storage Class and retires them instead.
+// Bound PVs are retired as they become Released.
+func (r *Releaser) drainPolicy(_ context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	if !isDraining(sc) {
+		return ActionContinue, ""
+	}
+	_, pinned := pv.ObjectMeta.Annotations[AnnotationOriginalClaim]
+	if pv.Status.Phase == corev1.VolumeBound && !pinned {
+		return ActionSkip, "SC is draining, waiting for PV to be released"
+	}
+	return ActionRetire, fmt.Sprintf("SC %s is draining", sc.ObjectMeta.Name)
+}
+
+// unpinAny deletes a helper PVC the PV is currently Bound to, along with any helper Jobs using it.
+// Returns true if there was one.
+func (r *Releaser) unpinAny(pv *corev1.PersistentVolume) (bool, error) {
+	claimRef := pv.Spec.ClaimRef
+	if pv.Status.Phase != corev1.VolumeBound || claimRef == nil {
+		return false, nil
+	}
+
+	pvcs := r.KubeClientSet.CoreV1().PersistentVolumeClaims(claimRef.Namespace)
+	pvc, err := pvcs.Get(r.Ctx, claimRef.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if pvc.ObjectMeta.Labels[LabelManagedBy] != r.ControllerId {
+		return false, fmt.Errorf("PV is bound to %s/%s", claimRef.Namespace, claimRef.Name)
+	}
+	if pvc.ObjectMeta.DeletionTimestamp != nil {
+		return true, nil
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	err = r.KubeClientSet.BatchV1().Jobs(claimRef.Namespace).DeleteCollection(
+		r.Ctx,
+		metav1.DeleteOptions{PropagationPolicy: &propagation},
+		metav1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set{
+				LabelManagedBy: r.ControllerId,
+				LabelPV:        pv.ObjectMeta.Name,
+			}).String(),
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	err = pvcs.Delete(r.Ctx, claimRef.Name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	klog.V(4).Infof("Unpinned PV %s from helper PVC %s/%s", pv.ObjectMeta.Name, claimRef.Namespace, claimRef.Name)
+	return true, nil
+}
+
+func (r *Releaser) enqueueSCOf(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pv, ok := obj.(*corev1.PersistentVolume)
+	if !ok || pv.Spec.StorageClassName == "" {
+		return
+	}
+	r.SCQueue.Add(pv.Spec.StorageClassName)
+}
+
+// scSyncHandler drives the drain of a Storage Class and reports its progress.
+func (r *Releaser) scSyncHandler(_, name string) error {
+	sc, err := r.SCLister.Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			r.forgetDrain(name)
+			return nil
+		}
+
+		return err
+	}
+
+	if sc.ObjectMeta.Annotations[AnnotationControllerId] != r.ControllerId || !isDraining(sc) {
+		r.forgetDrain(name)
+		return nil
+	}
+
+	pvs, err := r.PVLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	remaining, bound := 0, 0
+	for _, pv := range pvs {
+		if pv.Spec.StorageClassName != name {
+			continue
+		}
+		remaining++
+		if pv.Status.Phase == corev1.VolumeBound {
+			bound++
+			continue
+		}
+		// Available PVs would not get any events on their own
+		r.Enqueue(r.PVQueue, pv)
+	}
+
+	r.drainMutex.Lock()
+	last, reported := r.drainProgress[name]
+	r.drainProgress[name] = remaining
+	r.drainMutex.Unlock()
+
+	if reported && last == remaining {
+		return nil
+	}
+	if remaining == 0 {
+		r.Recorder.Event(sc, corev1.EventTypeNormal, DrainComplete, MessageSCDrainComplete)
+		return nil
+	}
+	r.Recorder.Event(sc, corev1.EventTypeNormal, Draining, fmt.Sprintf(MessageSCDraining, remaining, bound))
+	return nil
+}
+
+func (r *Releaser) forgetDrain(name string) {
+	r.drainMutex.Lock()
+	defer r.drainMutex.Unlock()
+	delete(r.drainProgress, name)
+}
+
+func (r *Releaser) setupDrain(scInformer cache.SharedIndexInformer) {
+	_, err := scInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			r.Enqueue(r.SCQueue, obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			r.Requeue(r.SCQueue, old, new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			r.Dequeue(r.SCQueue, obj)
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(err)
+	}
+}
@@ -0,0 +1,277 @@
+package releaser
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func drainTestSC(drain string) *storagev1.StorageClass {
+	annotations := map[string]string{AnnotationControllerId: "test"}
+	if drain != "" {
+		annotations[AnnotationDrain] = drain
+	}
+	return &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "pool", Annotations: annotations}}
+}
+
+func drainTestPV(name string, phase corev1.PersistentVolumePhase, claim string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.PersistentVolumeSpec{StorageClassName: "pool"},
+		Status:     corev1.PersistentVolumeStatus{Phase: phase},
+	}
+	if claim != "" {
+		pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "helpers", Name: claim}
+	}
+	return pv
+}
+
+func drainTestReleaser(objects ...runtime.Object) (*Releaser, *record.FakeRecorder) {
+	pvs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	scs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, obj := range objects {
+		switch obj.(type) {
+		case *corev1.PersistentVolume:
+			_ = pvs.Add(obj)
+		case *storagev1.StorageClass:
+			_ = scs.Add(obj)
+		}
+	}
+	recorder := record.NewFakeRecorder(10)
+	return &Releaser{
+		BasicController: controller.BasicController{
+			Ctx:           context.Background(),
+			ControllerId:  "test",
+			KubeClientSet: fake.NewSimpleClientset(objects...),
+			Recorder:      recorder,
+		},
+		SCLister:      storagelisters.NewStorageClassLister(scs),
+		PVLister:      corelisters.NewPersistentVolumeLister(pvs),
+		PVQueue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		drainMutex:    &sync.Mutex{},
+		drainProgress: make(map[string]int),
+	}, recorder
+}
+
+func TestDrainPolicy(t *testing.T) {
+	pinned := drainTestPV("pinned", corev1.VolumeBound, "clone-pinned")
+	pinned.ObjectMeta.Annotations = map[string]string{AnnotationOriginalClaim: "{}"}
+
+	tests := []struct {
+		name  string
+		drain string
+		pv    *corev1.PersistentVolume
+		want  Action
+	}{
+		{
+			name: "not draining",
+			pv:   drainTestPV("available", corev1.VolumeAvailable, ""),
+			want: ActionContinue,
+		},
+		{
+			name:  "drain disabled",
+			drain: "false",
+			pv:    drainTestPV("available", corev1.VolumeAvailable, ""),
+			want:  ActionContinue,
+		},
+		{
+			name:  "invalid drain",
+			drain: "soon",
+			pv:    drainTestPV("available", corev1.VolumeAvailable, ""),
+			want:  ActionContinue,
+		},
+		{
+			name:  "available",
+			drain: "true",
+			pv:    drainTestPV("available", corev1.VolumeAvailable, ""),
+			want:  ActionRetire,
+		},
+		{
+			name:  "released",
+			drain: "true",
+			pv:    drainTestPV("released", corev1.VolumeReleased, "cache"),
+			want:  ActionRetire,
+		},
+		{
+			name:  "bound",
+			drain: "true",
+			pv:    drainTestPV("bound", corev1.VolumeBound, "cache"),
+			want:  ActionSkip,
+		},
+		{
+			name:  "pinned by a helper",
+			drain: "true",
+			pv:    pinned,
+			want:  ActionRetire,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := drainTestReleaser()
+			action, reason := r.drainPolicy(context.Background(), test.pv, drainTestSC(test.drain))
+			if action != test.want {
+				t.Errorf("expected %s, got %s: %s", test.want, action, reason)
+			}
+		})
+	}
+}
+
+func TestUnpinAny(t *testing.T) {
+	helper := func(name, controllerId string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "helpers",
+			Labels:    map[string]string{LabelManagedBy: controllerId},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		pv          *corev1.PersistentVolume
+		want        bool
+		wantErr     bool
+		wantDeleted string
+	}{
+		{
+			name: "not bound",
+			pv:   drainTestPV("released", corev1.VolumeReleased, "clone-pv"),
+		},
+		{
+			name: "claim is gone",
+			pv:   drainTestPV("bound", corev1.VolumeBound, "missing"),
+		},
+		{
+			name:        "helper",
+			pv:          drainTestPV("bound", corev1.VolumeBound, "clone-pv"),
+			want:        true,
+			wantDeleted: "clone-pv",
+		},
+		{
+			name:    "claim of another controller",
+			pv:      drainTestPV("bound", corev1.VolumeBound, "foreign"),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := drainTestReleaser(helper("clone-pv", "test"), helper("foreign", "other"))
+			got, err := r.unpinAny(test.pv)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			if got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+			pvcs, err := r.KubeClientSet.CoreV1().PersistentVolumeClaims("helpers").List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pvc := range pvcs.Items {
+				if pvc.ObjectMeta.Name == test.wantDeleted {
+					t.Errorf("expected helper PVC %s to be deleted", test.wantDeleted)
+				}
+			}
+			if test.wantDeleted == "" && len(pvcs.Items) != 2 {
+				t.Errorf("expected no helper PVCs deleted, got %d left", len(pvcs.Items))
+			}
+		})
+	}
+}
+
+func TestSCSyncHandler(t *testing.T) {
+	eventReason := func(recorder *record.FakeRecorder) string {
+		select {
+		case event := <-recorder.Events:
+			return strings.SplitN(event, " ", 3)[1]
+		default:
+			return ""
+		}
+	}
+
+	t.Run("not draining", func(t *testing.T) {
+		r, recorder := drainTestReleaser(drainTestSC(""), drainTestPV("available", corev1.VolumeAvailable, ""))
+		defer r.PVQueue.ShutDown()
+		if err := r.scSyncHandler("", "pool"); err != nil {
+			t.Fatal(err)
+		}
+		if reason := eventReason(recorder); reason != "" {
+			t.Errorf("expected no event, got %s", reason)
+		}
+		if r.PVQueue.Len() != 0 {
+			t.Errorf("expected no PVs queued, got %d", r.PVQueue.Len())
+		}
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		r, recorder := drainTestReleaser(
+			drainTestSC("true"),
+			drainTestPV("available", corev1.VolumeAvailable, ""),
+			drainTestPV("bound", corev1.VolumeBound, "cache"),
+		)
+		defer r.PVQueue.ShutDown()
+
+		if err := r.scSyncHandler("", "pool"); err != nil {
+			t.Fatal(err)
+		}
+		if reason := eventReason(recorder); reason != Draining {
+			t.Errorf("expected %s event, got %q", Draining, reason)
+		}
+		// Bound PVs get events on their own once released
+		if r.PVQueue.Len() != 1 {
+			t.Errorf("expected the Available PV queued, got %d", r.PVQueue.Len())
+		}
+
+		if err := r.scSyncHandler("", "pool"); err != nil {
+			t.Fatal(err)
+		}
+		if reason := eventReason(recorder); reason != "" {
+			t.Errorf("expected no event while nothing changed, got %s", reason)
+		}
+
+		r.drainProgress["pool"] = 3
+		if err := r.scSyncHandler("", "pool"); err != nil {
+			t.Fatal(err)
+		}
+		if reason := eventReason(recorder); reason != Draining {
+			t.Errorf("expected %s event on change, got %q", Draining, reason)
+		}
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		r, recorder := drainTestReleaser(drainTestSC("true"))
+		defer r.PVQueue.ShutDown()
+		if err := r.scSyncHandler("", "pool"); err != nil {
+			t.Fatal(err)
+		}
+		if reason := eventReason(recorder); reason != DrainComplete {
+			t.Errorf("expected %s event, got %q", DrainComplete, reason)
+		}
+	})
+
+	t.Run("forgets stopped drains", func(t *testing.T) {
+		r, _ := drainTestReleaser(drainTestSC("false"))
+		defer r.PVQueue.ShutDown()
+		r.drainProgress["pool"] = 1
+		if err := r.scSyncHandler("", "pool"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r.drainProgress["pool"]; ok {
+			t.Error("expected drain progress to be forgotten")
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Storage Class annotations
+	AnnotationGoldenSnapshotClassKey     = "golden-snapshot-class"
+	AnnotationGoldenSnapshotClass        = AnnotationBaseName + "/" + AnnotationGoldenSnapshotClassKey
+	AnnotationGoldenSnapshotNamespaceKey = pool.AnnotationGoldenSnapshotNamespaceKey
+	AnnotationGoldenSnapshotNamespace    = pool.AnnotationGoldenSnapshotNamespace
+	AnnotationGoldenSnapshotIntervalKey  = "golden-snapshot-interval"
+	AnnotationGoldenSnapshotInterval     = AnnotationBaseName + "/" + AnnotationGoldenSnapshotIntervalKey
+	AnnotationGoldenSnapshotRetainKey    = "golden-snapshot-retain"
+	AnnotationGoldenSnapshotRetain       = AnnotationBaseName + "/" + AnnotationGoldenSnapshotRetainKey
+
+	// PV annotations
+	AnnotationGoldenClaimKey = "golden-claim"
+	AnnotationGoldenClaim    = AnnotationBaseName + "/" + AnnotationGoldenClaimKey
+
+	SnapshotGolden = pool.SnapshotGolden
+
+	DefaultGoldenSnapshotInterval = 24 * time.Hour
+	DefaultGoldenSnapshotRetain   = 2
+
+	goldenPrefix = "golden"
+
+	Promoted          = "Promoted"
+	MessagePVPromoted = "PV promoted to golden snapshot %s/%s"
+)
+
+type goldenConfig struct {
+	snapshotClass string
+	namespace     string
+	interval      time.Duration
+	retain        int
+}
+
+func (r *Releaser) parseGoldenConfig(sc *storagev1.StorageClass) (*goldenConfig, error) {
+	annotations := sc.ObjectMeta.Annotations
+	snapshotClass, ok := annotations[AnnotationGoldenSnapshotClass]
+	if !ok {
+		return nil, nil
+	}
+
+	c := &goldenConfig{
+		snapshotClass: snapshotClass,
+		namespace:     r.HelperNamespace,
+		interval:      DefaultGoldenSnapshotInterval,
+		retain:        DefaultGoldenSnapshotRetain,
+	}
+	if value, ok := annotations[AnnotationGoldenSnapshotNamespace]; ok {
+		c.namespace = value
+	}
+	if value, ok := annotations[AnnotationGoldenSnapshotInterval]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", AnnotationGoldenSnapshotInterval, err)
+		}
+		c.interval = interval
+	}
+	if value, ok := annotations[AnnotationGoldenSnapshotRetain]; ok {
+		retain, err := strconv.Atoi(value)
+		if err != nil || retain < 1 {
+			return nil, fmt.Errorf("invalid %s: %q", AnnotationGoldenSnapshotRetain, value)
+		}
+		c.retain = retain
+	}
+	if c.namespace == "" {
+		return nil, fmt.Errorf("neither %s nor -helper-namespace is set", AnnotationGoldenSnapshotNamespace)
+	}
+
+	return c, nil
+}
+
+// goldenPolicy promotes a Released PV to a golden snapshot once per interval.
+// Golden snapshots are used by Provisioner to seed new volumes of the pool.
+func (r *Releaser) goldenPolicy(_ context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	config, err := r.parseGoldenConfig(sc)
+	if err != nil {
+		r.Recorder.Event(sc, corev1.EventTypeWarning, ErrSnapshotPV, fmt.Sprintf(MessageSnapshotPV, err))
+		return ActionContinue, ""
+	}
+	if config == nil {
+		return ActionContinue, ""
+	}
+	if r.DynamicClient == nil {
+		klog.Warningf("SC %s defines golden snapshots, but there is no dynamic client - not promoting PV %s", sc.ObjectMeta.Name, pv.ObjectMeta.Name)
+		return ActionContinue, ""
+	}
+
+	original := OriginalClaimRef(pv)
+	_, pinned := pv.ObjectMeta.Annotations[AnnotationOriginalClaim]
+	if original == nil || (pv.Status.Phase != corev1.VolumeReleased && !pinned) {
+		return ActionContinue, ""
+	}
+	claim := string(original.UID)
+
+	if pv.ObjectMeta.Annotations[AnnotationGoldenClaim] != claim {
+		// Unique per PV and claim, so the same PV can be promoted again on its next release
+		name := helperName(goldenPrefix, fmt.Sprintf("%s-%s", pv.ObjectMeta.Name, claim))
+		due, err := r.goldenDue(sc, config, name)
+		if err != nil {
+			return ActionWait, fmt.Sprintf("failed to list golden snapshots: %s", err)
+		}
+		if due {
+			pvc, err := r.pinPV(pv, sc, goldenPrefix, config.namespace)
+			if err != nil {
+				return ActionWait, fmt.Sprintf("failed to pin PV: %s", err)
+			}
+			if pvc.Status.Phase != corev1.ClaimBound {
+				return ActionWait, fmt.Sprintf("waiting for helper PVC %s/%s to bind", pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+			}
+
+			ready, err := r.snapshot(pv, sc, pvc, name, config.snapshotClass, SnapshotGolden)
+			if err != nil {
+				return ActionWait, fmt.Sprintf("failed to snapshot PV: %s", err)
+			}
+			if !ready {
+				return ActionWait, fmt.Sprintf("waiting for VolumeSnapshot %s/%s to be ready", config.namespace, name)
+			}
+
+			pvCopy := pv.DeepCopy()
+			pvCopy.ObjectMeta.Annotations[AnnotationGoldenClaim] = claim
+			if _, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{}); err != nil {
+				return ActionWait, fmt.Sprintf("failed to record promotion: %s", err)
+			}
+			r.Recorder.Event(pv, corev1.EventTypeNormal, Promoted, fmt.Sprintf(MessagePVPromoted, config.namespace, name))
+
+			if err := r.pruneSnapshots(config.namespace, sc, SnapshotGolden, config.retain); err != nil {
+				klog.Warningf("Failed to prune old golden snapshots of SC %s: %s", sc.ObjectMeta.Name, err)
+			}
+			return ActionWait, "golden snapshot recorded"
+		}
+	}
+
+	unpinning, err := r.unpinPV(pv, goldenPrefix, config.namespace)
+	if err != nil {
+		return ActionWait, fmt.Sprintf("failed to unpin PV: %s", err)
+	}
+	if unpinning {
+		return ActionWait, "waiting for helper PVC to be deleted"
+	}
+	return ActionContinue, ""
+}
+
+// goldenDue returns true if the snapshot should be taken now.
+// That is when the latest golden snapshot is older than the interval, or this snapshot is already being taken.
+func (r *Releaser) goldenDue(sc *storagev1.StorageClass, config *goldenConfig, name string) (bool, error) {
+	list, err := r.DynamicClient.Resource(VolumeSnapshotResource).Namespace(config.namespace).List(r.Ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			LabelManagedBy:    r.ControllerId,
+			LabelStorageClass: sc.ObjectMeta.Name,
+			LabelSnapshot:     SnapshotGolden,
+		}).String(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	deadline := time.Now().Add(-config.interval)
+	due := true
+	for _, snapshot := range list.Items {
+		if snapshot.GetName() == name {
+			return true, nil
+		}
+		if snapshot.GetCreationTimestamp().Time.After(deadline) {
+			due = false
+		}
+	}
+	return due, nil
+}
@@ -0,0 +1,269 @@
+package releaser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// Helper PVCs are used to pin a Released PV, so its content could be accessed by Jobs or snapshots.
+// While pinned, the PV is Bound to the helper PVC and so it can't be claimed by anyone else.
+const (
+	AnnotationOriginalClaimKey = "original-claim"
+	AnnotationOriginalClaim    = AnnotationBaseName + "/" + AnnotationOriginalClaimKey
+
+	LabelBaseName     = pool.LabelBaseName
+	LabelManagedByKey = pool.LabelManagedByKey
+	LabelManagedBy    = pool.LabelManagedBy
+	LabelPVKey        = "pv"
+	LabelPV           = LabelBaseName + "/" + LabelPVKey
+	LabelHelperKey    = pool.LabelHelperKey
+	LabelHelper       = pool.LabelHelper
+
+	HelperVolumeName = "data"
+)
+
+// OriginalClaimRef returns a claimRef of the last real consumer of the PV.
+// It differs from spec.claimRef while the PV is pinned by (or was just unpinned from) a helper PVC.
+func OriginalClaimRef(pv *corev1.PersistentVolume) *corev1.ObjectReference {
+	if value, ok := pv.ObjectMeta.Annotations[AnnotationOriginalClaim]; ok {
+		var claimRef *corev1.ObjectReference
+		if err := json.Unmarshal([]byte(value), &claimRef); err == nil {
+			return claimRef
+		}
+		klog.Warningf("PV %s has invalid %s annotation: %s", pv.ObjectMeta.Name, AnnotationOriginalClaim, value)
+	}
+	return pv.Spec.ClaimRef
+}
+
+// helperName generates a DNS label safe name for a helper object of the PV.
+func helperName(prefix, pvName string) string {
+	name := fmt.Sprintf("%s-%s", prefix, pvName)
+	if len(name) <= 63 {
+		return name
+	}
+	sum := sha256.Sum256([]byte(pvName))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return strings.TrimRight(name[:63-len(hash)-1], "-.") + "-" + hash
+}
+
+func (r *Releaser) helperLabels(pv *corev1.PersistentVolume) map[string]string {
+	return map[string]string{
+		LabelManagedBy: r.ControllerId,
+		LabelPV:        pv.ObjectMeta.Name,
+	}
+}
+
+// pinPV makes sure a helper PVC exists and the PV is pre-bound to it.
+// Caller must check the PVC phase to know if the PV is actually Bound yet.
+func (r *Releaser) pinPV(pv *corev1.PersistentVolume, sc *storagev1.StorageClass, prefix, namespace string) (*corev1.PersistentVolumeClaim, error) {
+	name := helperName(prefix, pv.ObjectMeta.Name)
+	pvcs := r.KubeClientSet.CoreV1().PersistentVolumeClaims(namespace)
+
+	claimRef := pv.Spec.ClaimRef
+	if pv.Status.Phase == corev1.VolumeBound && claimRef != nil && (claimRef.Namespace != namespace || claimRef.Name != name) {
+		return nil, fmt.Errorf("PV is bound to %s/%s", claimRef.Namespace, claimRef.Name)
+	}
+
+	pvc, err := pvcs.Get(r.Ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		pvcLabels := r.helperLabels(pv)
+		pvcLabels[LabelHelper] = prefix
+		pvcLabels[LabelStorageClass] = sc.ObjectMeta.Name
+
+		volumeMode := pv.Spec.VolumeMode
+		pvc, err = pvcs.Create(r.Ctx, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    pvcLabels,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      pv.Spec.AccessModes,
+				StorageClassName: &sc.ObjectMeta.Name,
+				VolumeName:       pv.ObjectMeta.Name,
+				VolumeMode:       volumeMode,
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: pv.Spec.Capacity[corev1.ResourceStorage],
+					},
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		klog.V(4).Infof("Created helper PVC %s/%s for PV %s", namespace, name, pv.ObjectMeta.Name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.UID == pvc.ObjectMeta.UID {
+		return pvc, nil
+	}
+
+	pvCopy := pv.DeepCopy()
+	if _, ok := pvCopy.ObjectMeta.Annotations[AnnotationOriginalClaim]; !ok {
+		// Available PVs are recorded with null original claim
+		original, err := json.Marshal(pvCopy.Spec.ClaimRef)
+		if err != nil {
+			return nil, err
+		}
+		if pvCopy.ObjectMeta.Annotations == nil {
+			pvCopy.ObjectMeta.Annotations = make(map[string]string)
+		}
+		pvCopy.ObjectMeta.Annotations[AnnotationOriginalClaim] = string(original)
+	}
+	pvCopy.Spec.ClaimRef = &corev1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  pvc.ObjectMeta.Namespace,
+		Name:       pvc.ObjectMeta.Name,
+		UID:        pvc.ObjectMeta.UID,
+	}
+	if _, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{}); err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("Pinned PV %s to helper PVC %s/%s", pv.ObjectMeta.Name, namespace, name)
+
+	return pvc, nil
+}
+
+// unpinPV deletes the helper PVC and returns true if it was still there.
+// The PV becomes Released again once it is gone.
+func (r *Releaser) unpinPV(pv *corev1.PersistentVolume, prefix, namespace string) (bool, error) {
+	name := helperName(prefix, pv.ObjectMeta.Name)
+	pvcs := r.KubeClientSet.CoreV1().PersistentVolumeClaims(namespace)
+
+	pvc, err := pvcs.Get(r.Ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if pvc.ObjectMeta.DeletionTimestamp != nil {
+		return true, nil
+	}
+
+	err = pvcs.Delete(r.Ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	klog.V(4).Infof("Unpinned PV %s from helper PVC %s/%s", pv.ObjectMeta.Name, namespace, name)
+	return true, nil
+}
+
+// runHelperJob makes sure the Job exists and returns it, the Job gets the helper PVC mounted as HelperVolumeName volume.
+func (r *Releaser) runHelperJob(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim, prefix string, job *batchv1.Job) (*batchv1.Job, error) {
+	name := helperName(prefix, pv.ObjectMeta.Name)
+	jobs := r.KubeClientSet.BatchV1().Jobs(pvc.ObjectMeta.Namespace)
+
+	existing, err := jobs.Get(r.Ctx, name, metav1.GetOptions{})
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	job = job.DeepCopy()
+	job.ObjectMeta.Name = name
+	job.ObjectMeta.Namespace = pvc.ObjectMeta.Namespace
+	if job.ObjectMeta.Labels == nil {
+		job.ObjectMeta.Labels = make(map[string]string)
+	}
+	for k, v := range r.helperLabels(pv) {
+		job.ObjectMeta.Labels[k] = v
+	}
+	if job.Spec.Template.Spec.RestartPolicy == "" {
+		job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+
+	volume := corev1.Volume{
+		Name: HelperVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: pvc.ObjectMeta.Name,
+			},
+		},
+	}
+	replaced := false
+	for i, v := range job.Spec.Template.Spec.Volumes {
+		if v.Name == HelperVolumeName {
+			job.Spec.Template.Spec.Volumes[i] = volume
+			replaced = true
+		}
+	}
+	if !replaced {
+		job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, volume)
+	}
+
+	created, err := jobs.Create(r.Ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("Created helper Job %s/%s for PV %s", created.ObjectMeta.Namespace, created.ObjectMeta.Name, pv.ObjectMeta.Name)
+	return created, nil
+}
+
+// helperJobFinished returns whether the Job is finished and if it succeeded.
+func helperJobFinished(job *batchv1.Job) (finished bool, succeeded bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return true, true
+		case batchv1.JobFailed:
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// helperJobMessage returns the termination message of the first terminated container of the Job pods.
+func (r *Releaser) helperJobMessage(job *batchv1.Job) (string, error) {
+	pods, err := r.KubeClientSet.CoreV1().Pods(job.ObjectMeta.Namespace).List(r.Ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{batchv1.JobNameLabel: job.ObjectMeta.Name}).String(),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil && status.State.Terminated.Message != "" {
+				return status.State.Terminated.Message, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no termination message found for Job %s/%s", job.ObjectMeta.Namespace, job.ObjectMeta.Name)
+}
+
+func (r *Releaser) deleteHelperJob(pv *corev1.PersistentVolume, prefix, namespace string) error {
+	propagation := metav1.DeletePropagationBackground
+	err := r.KubeClientSet.BatchV1().Jobs(namespace).Delete(
+		r.Ctx,
+		helperName(prefix, pv.ObjectMeta.Name),
+		metav1.DeleteOptions{PropagationPolicy: &propagation},
+	)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
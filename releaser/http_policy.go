@@ -0,0 +1,236 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	VerdictAllow  = "allow"
+	VerdictDeny   = "deny"
+	VerdictRetire = "retire"
+)
+
+// HTTPPolicyRequest is a JSON document sent to the policy service for every release candidate.
+type HTTPPolicyRequest struct {
+	PersistentVolume *corev1.PersistentVolume `json:"persistentVolume"`
+	StorageClass     *storagev1.StorageClass  `json:"storageClass"`
+	ClaimRef         *corev1.ObjectReference  `json:"claimRef"`
+}
+
+// HTTPPolicyResponse is a JSON document expected back from the policy service.
+type HTTPPolicyResponse struct {
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type HTTPPolicyConfig struct {
+	// URL of the policy service endpoint, verdicts are requested via POST.
+	URL string
+	// Timeout for a single request.
+	Timeout time.Duration
+	// FailOpen allows the release if the policy service can't be reached or returned garbage.
+	// Otherwise the PV is checked again later.
+	FailOpen bool
+	// CacheTTL is how long a verdict is remembered for the same PV and claim, 0 disables caching.
+	CacheTTL time.Duration
+	// TLSConfig for the HTTP client, ignored if Client is set.
+	TLSConfig *tls.Config
+	// Client overrides the default HTTP client.
+	Client *http.Client
+}
+
+type httpPolicyVerdict struct {
+	response HTTPPolicyResponse
+	expires  time.Time
+}
+
+// HTTPPolicy is a ReleasePolicy that delegates the decision about Released PVs to an external HTTP service.
+type HTTPPolicy struct {
+	config HTTPPolicyConfig
+	client *http.Client
+
+	cacheMutex *sync.Mutex
+	cache      map[string]httpPolicyVerdict
+}
+
+func NewHTTPPolicy(config HTTPPolicyConfig) (*HTTPPolicy, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("policy service URL is required")
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: config.TLSConfig,
+			},
+		}
+	}
+
+	return &HTTPPolicy{
+		config:     config,
+		client:     client,
+		cacheMutex: &sync.Mutex{},
+		cache:      make(map[string]httpPolicyVerdict),
+	}, nil
+}
+
+// NewTLSConfig builds a client TLS config out of optional PEM files.
+func NewTLSConfig(caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (p *HTTPPolicy) Decide(ctx context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	if pv.Status.Phase != corev1.VolumeReleased || pv.Spec.ClaimRef == nil {
+		return ActionContinue, ""
+	}
+
+	key := fmt.Sprintf("%s/%s", pv.ObjectMeta.UID, OriginalClaimRef(pv).UID)
+	response, ok := p.cached(key)
+	if !ok {
+		var err error
+		response, err = p.query(ctx, pv, sc)
+		if err != nil {
+			if p.config.FailOpen {
+				klog.Warningf("Policy service failed for PV %s, failing open: %s", pv.ObjectMeta.Name, err)
+				return ActionContinue, ""
+			}
+			return ActionWait, fmt.Sprintf("policy service failed: %s", err)
+		}
+		p.remember(key, response)
+	}
+
+	reason := fmt.Sprintf("policy service verdict %q", response.Verdict)
+	if response.Reason != "" {
+		reason = fmt.Sprintf("%s: %s", reason, response.Reason)
+	}
+
+	switch response.Verdict {
+	case VerdictAllow:
+		return ActionContinue, ""
+	case VerdictRetire:
+		return ActionRetire, reason
+	default:
+		// Denied PVs are asked about again later, the policy service might change its mind
+		return ActionWait, reason
+	}
+}
+
+func (p *HTTPPolicy) query(ctx context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (HTTPPolicyResponse, error) {
+	var response HTTPPolicyResponse
+
+	body, err := json.Marshal(&HTTPPolicyRequest{
+		PersistentVolume: pv,
+		StorageClass:     sc,
+		ClaimRef:         OriginalClaimRef(pv),
+	})
+	if err != nil {
+		return response, err
+	}
+
+	if p.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return response, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&response); err != nil {
+		return response, fmt.Errorf("invalid response: %w", err)
+	}
+
+	switch response.Verdict {
+	case VerdictAllow, VerdictDeny, VerdictRetire:
+	default:
+		return response, fmt.Errorf("unknown verdict %q", response.Verdict)
+	}
+
+	klog.V(4).Infof("Policy service verdict for PV %s: %s", pv.ObjectMeta.Name, response.Verdict)
+	return response, nil
+}
+
+func (p *HTTPPolicy) cached(key string) (HTTPPolicyResponse, bool) {
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+
+	verdict, ok := p.cache[key]
+	if !ok || time.Now().After(verdict.expires) {
+		return HTTPPolicyResponse{}, false
+	}
+	return verdict.response, true
+}
+
+func (p *HTTPPolicy) remember(key string, response HTTPPolicyResponse) {
+	if p.config.CacheTTL <= 0 {
+		return
+	}
+
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+
+	now := time.Now()
+	for k, v := range p.cache {
+		if now.After(v.expires) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = httpPolicyVerdict{
+		response: response,
+		expires:  now.Add(p.config.CacheTTL),
+	}
+}
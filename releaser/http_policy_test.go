@@ -0,0 +1,253 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func httpPolicyTestPV(uid, claimUID types.UID) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-" + string(uid), UID: uid},
+		Spec: corev1.PersistentVolumeSpec{
+			ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "claim", UID: claimUID},
+		},
+		Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeReleased},
+	}
+}
+
+// httpPolicyTestServer replies with the verdict and counts the requests it served.
+func httpPolicyTestServer(t *testing.T, handler func(w http.ResponseWriter, request *HTTPPolicyRequest)) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if req.Method != http.MethodPost {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		request := &HTTPPolicyRequest{}
+		if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handler(w, request)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func verdictHandler(verdict, reason string) func(w http.ResponseWriter, request *HTTPPolicyRequest) {
+	return func(w http.ResponseWriter, request *HTTPPolicyRequest) {
+		_ = json.NewEncoder(w).Encode(&HTTPPolicyResponse{Verdict: verdict, Reason: reason})
+	}
+}
+
+func newTestHTTPPolicy(t *testing.T, server *httptest.Server, config HTTPPolicyConfig) *HTTPPolicy {
+	t.Helper()
+	config.URL = server.URL
+	config.Client = server.Client()
+	policy, err := NewHTTPPolicy(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return policy
+}
+
+func TestHTTPPolicyVerdicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, request *HTTPPolicyRequest)
+		want    Action
+	}{
+		{
+			name:    "allow",
+			handler: verdictHandler(VerdictAllow, ""),
+			want:    ActionContinue,
+		},
+		{
+			name:    "deny",
+			handler: verdictHandler(VerdictDeny, "on legal hold"),
+			want:    ActionWait,
+		},
+		{
+			name:    "retire",
+			handler: verdictHandler(VerdictRetire, "too old"),
+			want:    ActionRetire,
+		},
+		{
+			name:    "unknown verdict",
+			handler: verdictHandler("maybe", ""),
+			want:    ActionWait,
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, request *HTTPPolicyRequest) {
+				http.Error(w, "boom", http.StatusInternalServerError)
+			},
+			want: ActionWait,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := httpPolicyTestServer(t, test.handler)
+			policy := newTestHTTPPolicy(t, server, HTTPPolicyConfig{})
+
+			action, reason := policy.Decide(context.Background(), httpPolicyTestPV("pv", "claim"), &storagev1.StorageClass{})
+			if action != test.want {
+				t.Errorf("expected %s, got %s (%s)", test.want, action, reason)
+			}
+			if action != ActionContinue && reason == "" {
+				t.Errorf("expected a reason for %s", action)
+			}
+		})
+	}
+}
+
+func TestHTTPPolicyRequest(t *testing.T) {
+	var got *HTTPPolicyRequest
+	server, _ := httpPolicyTestServer(t, func(w http.ResponseWriter, request *HTTPPolicyRequest) {
+		got = request
+		verdictHandler(VerdictAllow, "")(w, request)
+	})
+	policy := newTestHTTPPolicy(t, server, HTTPPolicyConfig{})
+
+	sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "standard"}}
+	policy.Decide(context.Background(), httpPolicyTestPV("pv", "claim"), sc)
+	if got == nil {
+		t.Fatal("policy service was not called")
+	}
+	if got.PersistentVolume == nil || got.PersistentVolume.ObjectMeta.UID != "pv" {
+		t.Errorf("expected PV pv, got %v", got.PersistentVolume)
+	}
+	if got.StorageClass == nil || got.StorageClass.ObjectMeta.Name != "standard" {
+		t.Errorf("expected Storage Class standard, got %v", got.StorageClass)
+	}
+	if got.ClaimRef == nil || got.ClaimRef.UID != "claim" {
+		t.Errorf("expected claimRef claim, got %v", got.ClaimRef)
+	}
+}
+
+func TestHTTPPolicyNotReleased(t *testing.T) {
+	server, calls := httpPolicyTestServer(t, verdictHandler(VerdictRetire, ""))
+	policy := newTestHTTPPolicy(t, server, HTTPPolicyConfig{})
+
+	pv := httpPolicyTestPV("pv", "claim")
+	pv.Status.Phase = corev1.VolumeBound
+	if action, _ := policy.Decide(context.Background(), pv, &storagev1.StorageClass{}); action != ActionContinue {
+		t.Errorf("expected %s, got %s", ActionContinue, action)
+	}
+	if got := atomic.LoadInt32(calls); got != 0 {
+		t.Errorf("expected no calls for a Bound PV, got %d", got)
+	}
+}
+
+func TestHTTPPolicyTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		failOpen bool
+		want     Action
+	}{
+		{name: "fail open", failOpen: true, want: ActionContinue},
+		{name: "fail closed", failOpen: false, want: ActionWait},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			done := make(chan struct{})
+			server, _ := httpPolicyTestServer(t, func(w http.ResponseWriter, request *HTTPPolicyRequest) {
+				<-done
+				verdictHandler(VerdictRetire, "")(w, request)
+			})
+			// Unblock the handler before the server is closed
+			defer close(done)
+			policy := newTestHTTPPolicy(t, server, HTTPPolicyConfig{
+				Timeout:  50 * time.Millisecond,
+				FailOpen: test.failOpen,
+			})
+
+			action, _ := policy.Decide(context.Background(), httpPolicyTestPV("pv", "claim"), &storagev1.StorageClass{})
+			if action != test.want {
+				t.Errorf("expected %s, got %s", test.want, action)
+			}
+		})
+	}
+}
+
+func TestHTTPPolicyCache(t *testing.T) {
+	server, calls := httpPolicyTestServer(t, verdictHandler(VerdictRetire, ""))
+	policy := newTestHTTPPolicy(t, server, HTTPPolicyConfig{CacheTTL: 100 * time.Millisecond})
+	sc := &storagev1.StorageClass{}
+
+	decide := func(pv *corev1.PersistentVolume, wantCalls int32) {
+		t.Helper()
+		if action, _ := policy.Decide(context.Background(), pv, sc); action != ActionRetire {
+			t.Errorf("expected %s, got %s", ActionRetire, action)
+		}
+		if got := atomic.LoadInt32(calls); got != wantCalls {
+			t.Errorf("expected %d calls, got %d", wantCalls, got)
+		}
+	}
+
+	decide(httpPolicyTestPV("pv", "claim"), 1)
+	// Same PV and claim
+	decide(httpPolicyTestPV("pv", "claim"), 1)
+	// Same PV released by another claim
+	decide(httpPolicyTestPV("pv", "other-claim"), 2)
+	// Another PV released by the same claim UID
+	decide(httpPolicyTestPV("other-pv", "claim"), 3)
+
+	time.Sleep(150 * time.Millisecond)
+	decide(httpPolicyTestPV("pv", "claim"), 4)
+}
+
+func TestHTTPPolicyCacheDisabled(t *testing.T) {
+	server, calls := httpPolicyTestServer(t, verdictHandler(VerdictAllow, ""))
+	policy := newTestHTTPPolicy(t, server, HTTPPolicyConfig{})
+
+	for i := 0; i < 2; i++ {
+		policy.Decide(context.Background(), httpPolicyTestPV("pv", "claim"), &storagev1.StorageClass{})
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Errorf("expected 2 calls without cache, got %d", got)
+	}
+}
+
+func TestHTTPPolicyFailuresNotCached(t *testing.T) {
+	var fail int32 = 1
+	server, calls := httpPolicyTestServer(t, func(w http.ResponseWriter, request *HTTPPolicyRequest) {
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(w, "boom", http.StatusServiceUnavailable)
+			return
+		}
+		verdictHandler(VerdictAllow, "")(w, request)
+	})
+	policy := newTestHTTPPolicy(t, server, HTTPPolicyConfig{CacheTTL: time.Minute})
+
+	if action, _ := policy.Decide(context.Background(), httpPolicyTestPV("pv", "claim"), &storagev1.StorageClass{}); action != ActionWait {
+		t.Errorf("expected %s, got %s", ActionWait, action)
+	}
+	atomic.StoreInt32(&fail, 0)
+	if action, _ := policy.Decide(context.Background(), httpPolicyTestPV("pv", "claim"), &storagev1.StorageClass{}); action != ActionContinue {
+		t.Errorf("expected %s, got %s", ActionContinue, action)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Errorf("expected 2 calls, got %d", got)
+	}
+}
+
+func TestNewHTTPPolicyRequiresURL(t *testing.T) {
+	if _, err := NewHTTPPolicy(HTTPPolicyConfig{}); err == nil {
+		t.Error("expected an error without URL")
+	}
+}
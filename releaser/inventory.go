@@ -0,0 +1,397 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	InventoryKind = "PoolInventory"
+
+	// Annotations that only make sense in the cluster they were set in
+	annotationBoundByController = "pv.kubernetes.io/bound-by-controller"
+)
+
+// Inventory is a portable bundle of pool PVs, produced by export and consumed by import.
+type Inventory struct {
+	Kind              string                    `json:"kind"`
+	ControllerId      string                    `json:"controllerId"`
+	ExportedAt        metav1.Time               `json:"exportedAt"`
+	PersistentVolumes []corev1.PersistentVolume `json:"persistentVolumes"`
+}
+
+// Export is a command that dumps pool PVs to a bundle that can be imported into another cluster.
+//
+//	reclaimable-pv-releaser -controller-id=... export [-storage-class=pool] [-output=pools.yaml] [-format=yaml|json]
+func Export(
+	ctx context.Context,
+	_ *rest.Config,
+	client clientset.Interface,
+	controllerId string,
+	args []string,
+) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	storageClass := flags.String("storage-class", "", "optional, export only this pool; defaults to every Storage Class annotated with -controller-id")
+	output := flags.String("output", "-", "file to write the bundle to, - for stdout")
+	format := flags.String("format", "yaml", "bundle format, yaml or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "yaml" && *format != "json" {
+		return fmt.Errorf("unknown -format %q", *format)
+	}
+
+	pools, err := poolSCs(ctx, client, controllerId)
+	if err != nil {
+		return err
+	}
+	if *storageClass != "" {
+		if _, ok := pools[*storageClass]; !ok {
+			return fmt.Errorf("SC %s is not annotated with %s=%s", *storageClass, AnnotationControllerId, controllerId)
+		}
+		pools = map[string]struct{}{*storageClass: {}}
+	}
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	inventory := Inventory{
+		Kind:              InventoryKind,
+		ControllerId:      controllerId,
+		ExportedAt:        metav1.NewTime(time.Now().UTC()),
+		PersistentVolumes: []corev1.PersistentVolume{},
+	}
+	for _, pv := range pvs.Items {
+		if exportable(&pv, pools) {
+			inventory.PersistentVolumes = append(inventory.PersistentVolumes, portablePV(&pv))
+		}
+	}
+
+	var data []byte
+	if *format == "json" {
+		data, err = json.MarshalIndent(inventory, "", "  ")
+	} else {
+		data, err = yaml.Marshal(inventory)
+	}
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	klog.Infof("Exported %d PVs", len(inventory.PersistentVolumes))
+	return nil
+}
+
+// exportable returns true if the PV belongs to one of the pools and is not going away.
+func exportable(pv *corev1.PersistentVolume, pools map[string]struct{}) bool {
+	if _, ok := pools[pv.Spec.StorageClassName]; !ok {
+		return false
+	}
+	if _, ok := pv.ObjectMeta.Annotations[AnnotationRetiring]; ok || pv.ObjectMeta.DeletionTimestamp != nil {
+		klog.V(5).Infof("PV %s is going away, skip", pv.ObjectMeta.Name)
+		return false
+	}
+	return true
+}
+
+// portablePV strips everything tied to the source cluster, so the PV could be created as Available elsewhere.
+func portablePV(pv *corev1.PersistentVolume) corev1.PersistentVolume {
+	annotations := map[string]string{}
+	for k, v := range pv.ObjectMeta.Annotations {
+		switch k {
+		case annotationBoundByController, AnnotationOriginalClaim, AnnotationRetiring:
+			continue
+		}
+		annotations[k] = v
+	}
+
+	spec := *pv.Spec.DeepCopy()
+	spec.ClaimRef = nil
+
+	return corev1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "PersistentVolume",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.ObjectMeta.Name,
+			Labels:      pv.ObjectMeta.Labels,
+			Annotations: annotations,
+		},
+		Spec: spec,
+	}
+}
+
+// Import is a command that recreates PVs from an export bundle as Available.
+//
+//	reclaimable-pv-releaser -controller-id=... import [-input=pools.yaml] [-dry-run] [-ignore-topology]
+func Import(
+	ctx context.Context,
+	_ *rest.Config,
+	client clientset.Interface,
+	controllerId string,
+	args []string,
+) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := flags.String("input", "-", "file to read the bundle from, - for stdin")
+	dryRun := flags.Bool("dry-run", false, "only print what would be done")
+	ignoreTopology := flags.Bool("ignore-topology", false, "import PVs even if no node matches their node affinity")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var data []byte
+	var err error
+	if *input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*input)
+	}
+	if err != nil {
+		return err
+	}
+
+	inventory := Inventory{}
+	if err := yaml.Unmarshal(data, &inventory); err != nil {
+		return err
+	}
+	if inventory.Kind != InventoryKind {
+		return fmt.Errorf("expected kind %s, got %q", InventoryKind, inventory.Kind)
+	}
+
+	pools, err := poolSCs(ctx, client, controllerId)
+	if err != nil {
+		return err
+	}
+
+	existing, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	target := newImportTarget(controllerId, pools, existing.Items, nodes.Items)
+
+	imported, skipped, flagged, failed := 0, 0, 0, 0
+	for i := range inventory.PersistentVolumes {
+		pv := portablePV(&inventory.PersistentVolumes[i])
+		name := pv.ObjectMeta.Name
+
+		verdict, reason := target.verdict(&pv)
+		switch verdict {
+		case importSkip:
+			fmt.Printf("skipped PV %s: %s\n", name, reason)
+			skipped++
+			continue
+		case importFlag, importFlagTopology:
+			fmt.Printf("flagged PV %s: %s\n", name, reason)
+			flagged++
+			if verdict == importFlag || !*ignoreTopology {
+				continue
+			}
+		}
+
+		if *dryRun {
+			fmt.Printf("would import PV %s\n", name)
+			imported++
+			continue
+		}
+		if _, err := client.CoreV1().PersistentVolumes().Create(ctx, &pv, metav1.CreateOptions{}); err != nil {
+			if errors.IsAlreadyExists(err) {
+				fmt.Printf("skipped PV %s: already exists\n", name)
+				skipped++
+				continue
+			}
+			klog.Errorf("Failed to import PV %s: %s", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("imported PV %s\n", name)
+		imported++
+	}
+
+	if *dryRun {
+		fmt.Printf("dry-run: %d PVs would be imported, %d skipped, %d flagged\n", imported, skipped, flagged)
+		return nil
+	}
+	fmt.Printf("%d PVs imported, %d skipped, %d flagged, %d failed\n", imported, skipped, flagged, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to import %d PVs", failed)
+	}
+	return nil
+}
+
+// Verdicts of import on a PV from the bundle
+const (
+	importCreate = iota
+	importSkip
+	importFlag
+	// importFlagTopology is imported anyway with -ignore-topology
+	importFlagTopology
+)
+
+// importTarget is what import knows about the cluster it imports into.
+type importTarget struct {
+	controllerId string
+	pools        map[string]struct{}
+	names        map[string]struct{}
+	handles      map[string]string
+	nodes        []corev1.Node
+}
+
+func newImportTarget(controllerId string, pools map[string]struct{}, existing []corev1.PersistentVolume, nodes []corev1.Node) *importTarget {
+	target := &importTarget{
+		controllerId: controllerId,
+		pools:        pools,
+		names:        map[string]struct{}{},
+		handles:      map[string]string{},
+		nodes:        nodes,
+	}
+	for _, pv := range existing {
+		target.names[pv.ObjectMeta.Name] = struct{}{}
+		if csi := pv.Spec.CSI; csi != nil {
+			target.handles[csi.Driver+"/"+csi.VolumeHandle] = pv.ObjectMeta.Name
+		}
+	}
+	return target
+}
+
+// verdict decides whether the PV is created, with a reason if it is not.
+// PVs already in the cluster are skipped, PVs that would not be usable there are flagged.
+func (t *importTarget) verdict(pv *corev1.PersistentVolume) (int, string) {
+	if _, ok := t.names[pv.ObjectMeta.Name]; ok {
+		return importSkip, "already exists"
+	}
+	if csi := pv.Spec.CSI; csi != nil {
+		if other, ok := t.handles[csi.Driver+"/"+csi.VolumeHandle]; ok {
+			return importSkip, fmt.Sprintf("volume %s already exists as PV %s", csi.VolumeHandle, other)
+		}
+	}
+	if _, ok := t.pools[pv.Spec.StorageClassName]; !ok {
+		return importFlag, fmt.Sprintf("SC %q is not annotated with %s=%s", pv.Spec.StorageClassName, AnnotationControllerId, t.controllerId)
+	}
+	if matches, err := anyNodeMatches(pv, t.nodes); err != nil {
+		return importFlagTopology, fmt.Sprintf("topology mismatch: %s", err)
+	} else if !matches {
+		return importFlagTopology, "topology mismatch: no node matches its node affinity"
+	}
+	return importCreate, ""
+}
+
+// poolSCs returns names of Storage Classes managed by this controller.
+func poolSCs(ctx context.Context, client clientset.Interface, controllerId string) (map[string]struct{}, error) {
+	list, err := client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pools := map[string]struct{}{}
+	for _, sc := range list.Items {
+		if sc.ObjectMeta.Annotations[AnnotationControllerId] == controllerId {
+			pools[sc.ObjectMeta.Name] = struct{}{}
+		}
+	}
+	return pools, nil
+}
+
+// anyNodeMatches returns true if the PV has no node affinity or at least one node satisfies it.
+func anyNodeMatches(pv *corev1.PersistentVolume, nodes []corev1.Node) (bool, error) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return true, nil
+	}
+
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		selector, err := nodeSelectorTermSelector(term)
+		if err != nil {
+			return false, err
+		}
+		for _, node := range nodes {
+			if selector.Matches(labels.Set(node.ObjectMeta.Labels)) && nodeFieldsMatch(term, &node) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// nodeSelectorTermSelector converts match expressions of the term to a label selector.
+// An empty term matches no nodes, like it does in Kubernetes.
+func nodeSelectorTermSelector(term corev1.NodeSelectorTerm) (labels.Selector, error) {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return labels.Nothing(), nil
+	}
+	selector := labels.NewSelector()
+	for _, expression := range term.MatchExpressions {
+		var op selection.Operator
+		switch expression.Operator {
+		case corev1.NodeSelectorOpIn:
+			op = selection.In
+		case corev1.NodeSelectorOpNotIn:
+			op = selection.NotIn
+		case corev1.NodeSelectorOpExists:
+			op = selection.Exists
+		case corev1.NodeSelectorOpDoesNotExist:
+			op = selection.DoesNotExist
+		case corev1.NodeSelectorOpGt:
+			op = selection.GreaterThan
+		case corev1.NodeSelectorOpLt:
+			op = selection.LessThan
+		default:
+			return nil, fmt.Errorf("unsupported node selector operator %q", expression.Operator)
+		}
+		requirement, err := labels.NewRequirement(expression.Key, op, expression.Values)
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*requirement)
+	}
+	return selector, nil
+}
+
+// nodeFieldsMatch supports metadata.name, the only field Kubernetes allows in node selector terms.
+func nodeFieldsMatch(term corev1.NodeSelectorTerm, node *corev1.Node) bool {
+	for _, field := range term.MatchFields {
+		if field.Key != "metadata.name" {
+			return false
+		}
+		found := false
+		for _, value := range field.Values {
+			if value == node.ObjectMeta.Name {
+				found = true
+			}
+		}
+		if (field.Operator == corev1.NodeSelectorOpIn) != found {
+			return false
+		}
+	}
+	return true
+}
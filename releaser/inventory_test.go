@@ -0,0 +1,191 @@
+package releaser
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func inventoryTestNode(name, zone string) corev1.Node {
+	return corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{"topology.kubernetes.io/zone": zone},
+	}}
+}
+
+func inventoryTestPV(name, storageClass string, terms ...corev1.NodeSelectorTerm) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			StorageClassName: storageClass,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-" + name},
+			},
+		},
+	}
+	if terms != nil {
+		pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+			Required: &corev1.NodeSelector{NodeSelectorTerms: terms},
+		}
+	}
+	return pv
+}
+
+func zoneTerm(operator corev1.NodeSelectorOperator, zones ...string) corev1.NodeSelectorTerm {
+	return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+		{Key: "topology.kubernetes.io/zone", Operator: operator, Values: zones},
+	}}
+}
+
+func TestAnyNodeMatches(t *testing.T) {
+	nodes := []corev1.Node{inventoryTestNode("node-a", "zone-a"), inventoryTestNode("node-b", "zone-b")}
+
+	tests := []struct {
+		name    string
+		terms   []corev1.NodeSelectorTerm
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "no node affinity",
+			want: true,
+		},
+		{
+			name:  "zone exists",
+			terms: []corev1.NodeSelectorTerm{zoneTerm(corev1.NodeSelectorOpIn, "zone-b")},
+			want:  true,
+		},
+		{
+			name:  "zone missing",
+			terms: []corev1.NodeSelectorTerm{zoneTerm(corev1.NodeSelectorOpIn, "zone-c")},
+		},
+		{
+			name:  "any term matches",
+			terms: []corev1.NodeSelectorTerm{zoneTerm(corev1.NodeSelectorOpIn, "zone-c"), zoneTerm(corev1.NodeSelectorOpNotIn, "zone-a")},
+			want:  true,
+		},
+		{
+			name:  "empty term matches nothing",
+			terms: []corev1.NodeSelectorTerm{{}},
+		},
+		{
+			name: "node name",
+			terms: []corev1.NodeSelectorTerm{{MatchFields: []corev1.NodeSelectorRequirement{
+				{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node-b"}},
+			}}},
+			want: true,
+		},
+		{
+			name: "node name missing",
+			terms: []corev1.NodeSelectorTerm{{MatchFields: []corev1.NodeSelectorRequirement{
+				{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node-c"}},
+			}}},
+		},
+		{
+			name: "unsupported operator",
+			terms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: "topology.kubernetes.io/zone", Operator: "Near"},
+			}}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := anyNodeMatches(inventoryTestPV("pv", "pool", test.terms...), nodes)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			if got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestExportable(t *testing.T) {
+	pools := map[string]struct{}{"pool": {}}
+	retiring := inventoryTestPV("retiring", "pool")
+	retiring.ObjectMeta.Annotations = map[string]string{AnnotationRetiring: "true"}
+	deleted := inventoryTestPV("deleted", "pool")
+	deleted.ObjectMeta.DeletionTimestamp = &metav1.Time{}
+
+	tests := []struct {
+		pv   *corev1.PersistentVolume
+		want bool
+	}{
+		{pv: inventoryTestPV("pooled", "pool"), want: true},
+		{pv: inventoryTestPV("other", "standard")},
+		{pv: retiring},
+		{pv: deleted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pv.ObjectMeta.Name, func(t *testing.T) {
+			if got := exportable(test.pv, pools); got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestImportVerdict(t *testing.T) {
+	target := newImportTarget(
+		"test",
+		map[string]struct{}{"pool": {}},
+		[]corev1.PersistentVolume{*inventoryTestPV("existing", "pool"), *inventoryTestPV("renamed", "pool")},
+		[]corev1.Node{inventoryTestNode("node-a", "zone-a")},
+	)
+	sameVolume := inventoryTestPV("imported", "pool")
+	sameVolume.Spec.CSI.VolumeHandle = "vol-renamed"
+
+	tests := []struct {
+		name string
+		pv   *corev1.PersistentVolume
+		want int
+	}{
+		{
+			name: "new",
+			pv:   inventoryTestPV("new", "pool", zoneTerm(corev1.NodeSelectorOpIn, "zone-a")),
+			want: importCreate,
+		},
+		{
+			name: "name exists",
+			pv:   inventoryTestPV("existing", "pool"),
+			want: importSkip,
+		},
+		{
+			name: "volume exists",
+			pv:   sameVolume,
+			want: importSkip,
+		},
+		{
+			name: "not a pool",
+			pv:   inventoryTestPV("new", "standard"),
+			want: importFlag,
+		},
+		{
+			name: "topology mismatch",
+			pv:   inventoryTestPV("new", "pool", zoneTerm(corev1.NodeSelectorOpIn, "zone-b")),
+			want: importFlagTopology,
+		},
+		{
+			name: "empty node affinity term",
+			pv:   inventoryTestPV("new", "pool", corev1.NodeSelectorTerm{}),
+			want: importFlagTopology,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, reason := target.verdict(test.pv)
+			if got != test.want {
+				t.Errorf("expected verdict %d, got %d: %s", test.want, got, reason)
+			}
+			if (got == importCreate) != (reason == "") {
+				t.Errorf("expected a reason only if the PV is not created, got %q", reason)
+			}
+		})
+	}
+}
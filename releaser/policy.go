@@ -0,0 +1,92 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+// Action is a verdict of a ReleasePolicy on what to do with a PV.
+type Action int
+
+const (
+	// ActionContinue means the policy has no opinion - the next policy in the chain decides.
+	// If every policy in the chain continues - the PV is released.
+	ActionContinue Action = iota
+	// ActionSkip means the PV must be left alone.
+	ActionSkip
+	// ActionRelease means the PV must be released right away, remaining policies are not consulted.
+	ActionRelease
+	// ActionRetire means the PV must be taken out of the pool - its reclaim policy is flipped to Delete.
+	ActionRetire
+	// ActionWait means the PV must be left alone for now and checked again later.
+	ActionWait
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionContinue:
+		return "continue"
+	case ActionSkip:
+		return "skip"
+	case ActionRelease:
+		return "release"
+	case ActionRetire:
+		return "retire"
+	case ActionWait:
+		return "wait"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// ReleasePolicy decides what Releaser should do with a PV.
+// Policies are evaluated in order, the first one that returns anything but ActionContinue wins.
+// The reason is a human readable explanation used for logging and events.
+type ReleasePolicy interface {
+	Decide(ctx context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string)
+}
+
+// PolicyFunc is an adapter to use an ordinary function as a ReleasePolicy.
+type PolicyFunc func(ctx context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string)
+
+func (f PolicyFunc) Decide(ctx context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	return f(ctx, pv, sc)
+}
+
+// ControllerIdPolicy is the default policy.
+// It skips PVs which Storage Class is not annotated with this controller ID.
+type ControllerIdPolicy struct {
+	ControllerId string
+}
+
+func (p *ControllerIdPolicy) Decide(_ context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	manager, ok := sc.ObjectMeta.Annotations[AnnotationControllerId]
+	if !ok || manager != p.ControllerId {
+		return ActionSkip, fmt.Sprintf("SC %q for PV %q is not associated with this controller ID %q", sc.ObjectMeta.Name, pv.ObjectMeta.Name, p.ControllerId)
+	}
+	return ActionContinue, ""
+}
+
+// Decide runs the PV through the policy chain.
+func Decide(ctx context.Context, policies []ReleasePolicy, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	for _, policy := range policies {
+		action, reason := policy.Decide(ctx, pv, sc)
+		if action != ActionContinue {
+			return action, reason
+		}
+	}
+	return ActionRelease, "all policies passed"
+}
+
+// Option configures optional Releaser behavior.
+type Option func(*Releaser)
+
+// WithPolicies appends policies to the chain after the default ControllerIdPolicy.
+func WithPolicies(policies ...ReleasePolicy) Option {
+	return func(r *Releaser) {
+		r.Policies = append(r.Policies, policies...)
+	}
+}
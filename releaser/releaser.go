@@ -4,15 +4,19 @@ package releaser
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
 	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	storagelisters "k8s.io/client-go/listers/storage/v1"
@@ -22,17 +26,31 @@ import (
 )
 
 const (
-	AgentName = "reclaimable-pv-releaser"
+	AgentName = pool.ReleaserName
 
-	AnnotationBaseName        = AgentName + ".kubernetes.io"
-	AnnotationControllerIdKey = "controller-id"
-	AnnotationControllerId    = AnnotationBaseName + "/" + AnnotationControllerIdKey
+	AnnotationBaseName        = pool.AnnotationBaseName
+	AnnotationControllerIdKey = pool.AnnotationControllerIdKey
+	AnnotationControllerId    = pool.AnnotationControllerId
+	AnnotationRetiringKey     = "retiring"
+	AnnotationRetiring        = AnnotationBaseName + "/" + AnnotationRetiringKey
+
+	// PV history, i.e. to tell reused PVs from fresh ones
+	AnnotationReleaseCountKey   = pool.AnnotationReleaseCountKey
+	AnnotationReleaseCount      = pool.AnnotationReleaseCount
+	AnnotationLastReleasedAtKey = "last-released-at"
+	AnnotationLastReleasedAt    = AnnotationBaseName + "/" + AnnotationLastReleasedAtKey
 
 	Released          = "Released"
 	MessagePVReleased = "PV released successfully"
 
 	MessageReleasePV = "error releasing PV %s: %s"
 	ErrReleasePV     = "ErrReleasePV"
+
+	Retired          = "Retired"
+	MessagePVRetired = "PV retired: %s"
+
+	MessageRetirePV = "error retiring PV %s: %s"
+	ErrRetirePV     = "ErrRetirePV"
 )
 
 type Releaser struct {
@@ -44,8 +62,23 @@ type Releaser struct {
 	PVSynced cache.InformerSynced
 	PVQueue  workqueue.RateLimitingInterface
 
+	SCSynced cache.InformerSynced
+	SCQueue  workqueue.RateLimitingInterface
+
+	Policies     []ReleasePolicy
+	WaitInterval time.Duration
+
+	HelperNamespace string
+	ProbeImage      string
+	DynamicClient   dynamic.Interface
+
+	ReservationConfig *ReservationConfig
+
 	managedSCMutex *sync.Mutex
 	managedSCSet   map[string]struct{}
+
+	drainMutex    *sync.Mutex
+	drainProgress map[string]int
 }
 
 func New(
@@ -53,6 +86,7 @@ func New(
 	kubeClientSet kubernetes.Interface,
 	namespace,
 	controllerId string,
+	opts ...Option,
 ) controller.Controller {
 	klog.Info("Releaser starting...")
 
@@ -74,10 +108,37 @@ func New(
 		PVSynced: pvInformer.Informer().HasSynced,
 		PVQueue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "PersistentVolumes"),
 
+		SCSynced: scInformer.Informer().HasSynced,
+		SCQueue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "StorageClasses"),
+
+		Policies:     []ReleasePolicy{&ControllerIdPolicy{ControllerId: controllerId}},
+		WaitInterval: time.Second * 30,
+
+		ProbeImage: "busybox",
+
 		managedSCMutex: &sync.Mutex{},
 		managedSCSet:   make(map[string]struct{}),
+
+		drainMutex:    &sync.Mutex{},
+		drainProgress: make(map[string]int),
 	}
 
+	// Retiring, draining and reservations override any custom policy
+	r.Policies = append(r.Policies, PolicyFunc(retiringPolicy), PolicyFunc(r.drainPolicy), PolicyFunc(r.reservationPolicy))
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	// Built-in policies run after the custom ones, they might need to pin the PV to work with its content
+	r.Policies = append(
+		r.Policies,
+		PolicyFunc(r.cloneSourcePolicy),
+		PolicyFunc(r.usagePolicy),
+		PolicyFunc(r.goldenPolicy),
+		PolicyFunc(r.clonePolicy),
+	)
+
 	klog.V(2).Info("Setting up event handlers")
 
 	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -86,11 +147,14 @@ func New(
 		},
 		UpdateFunc: func(old, new interface{}) {
 			r.Requeue(r.PVQueue, old, new)
+			r.enqueueSCOf(new)
 		},
 		DeleteFunc: func(obj interface{}) {
 			r.Dequeue(r.PVQueue, obj)
+			r.enqueueSCOf(obj)
 		},
 	})
+	r.setupDrain(scInformer.Informer())
 
 	return r
 }
@@ -102,10 +166,16 @@ func (r *Releaser) Run(threadiness int, stopCh <-chan struct{}) error {
 		func(threadiness int, stopCh <-chan struct{}) error {
 			klog.V(2).Info("Waiting for informer caches to sync")
 
-			if ok := cache.WaitForCacheSync(stopCh, r.PVSynced); !ok {
+			if ok := cache.WaitForCacheSync(stopCh, r.PVSynced, r.SCSynced); !ok {
 				return fmt.Errorf("failed to wait for PV caches to sync")
 			}
 
+			if r.ReservationConfig != nil {
+				if err := r.serveReservations(stopCh); err != nil {
+					return err
+				}
+			}
+
 			klog.V(2).Info("Starting workers")
 			for i := 0; i < threadiness; i++ {
 				go wait.Until(
@@ -114,6 +184,11 @@ func (r *Releaser) Run(threadiness int, stopCh <-chan struct{}) error {
 					stopCh,
 				)
 			}
+			go wait.Until(
+				r.RunWorker("sc", r.SCQueue, r.scSyncHandler),
+				time.Second,
+				stopCh,
+			)
 
 			return nil
 		},
@@ -121,6 +196,9 @@ func (r *Releaser) Run(threadiness int, stopCh <-chan struct{}) error {
 			if r.PVQueue != nil {
 				r.PVQueue.ShutDown()
 			}
+			if r.SCQueue != nil {
+				r.SCQueue.ShutDown()
+			}
 		},
 	)
 }
@@ -154,11 +232,18 @@ func (r *Releaser) pvSyncHandler(_, name string) error {
 		return err
 	}
 
-	manager, ok := sc.ObjectMeta.Annotations[AnnotationControllerId]
-	if ok && manager == r.ControllerId {
+	action, reason := Decide(r.Ctx, r.Policies, pv, sc)
+	switch action {
+	case ActionRelease:
+		klog.V(6).Infof("PV %q release decision: %s", pv.ObjectMeta.Name, reason)
 		return r.pvReleaseHandler(pv)
-	} else {
-		klog.V(5).Infof("SC %q for PV %q is not associated with this controller ID %q, skip", pv.Spec.StorageClassName, pv.ObjectMeta.Name, r.ControllerId)
+	case ActionRetire:
+		return r.pvRetireHandler(pv, sc, reason)
+	case ActionWait:
+		klog.V(4).Infof("PV %q will be checked again in %s: %s", pv.ObjectMeta.Name, r.WaitInterval, reason)
+		r.PVQueue.AddAfter(name, r.WaitInterval)
+	default:
+		klog.V(5).Infof("PV %q %s: %s", pv.ObjectMeta.Name, action, reason)
 	}
 
 	return nil
@@ -180,6 +265,15 @@ func (r *Releaser) pvReleaseHandler(pv *corev1.PersistentVolume) error {
 
 	pvCopy := pv.DeepCopy()
 	pvCopy.Spec.ClaimRef = nil
+	delete(pvCopy.ObjectMeta.Annotations, AnnotationOriginalClaim)
+	delete(pvCopy.ObjectMeta.Annotations, AnnotationReservationId)
+	delete(pvCopy.ObjectMeta.Annotations, AnnotationReservationExpires)
+	if pvCopy.ObjectMeta.Annotations == nil {
+		pvCopy.ObjectMeta.Annotations = make(map[string]string)
+	}
+	releaseCount, _ := strconv.Atoi(pvCopy.ObjectMeta.Annotations[AnnotationReleaseCount])
+	pvCopy.ObjectMeta.Annotations[AnnotationReleaseCount] = strconv.Itoa(releaseCount + 1)
+	pvCopy.ObjectMeta.Annotations[AnnotationLastReleasedAt] = time.Now().UTC().Format(time.RFC3339)
 	_, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{})
 	if err != nil {
 		if errors.IsConflict(err) {
@@ -199,3 +293,110 @@ func (r *Releaser) pvReleaseHandler(pv *corev1.PersistentVolume) error {
 	r.Recorder.Event(pv, corev1.EventTypeNormal, Released, MessagePVReleased)
 	return nil
 }
+
+// retiringPolicy carries on with retirement of PVs that started it, right after ControllerIdPolicy.
+// Once started, retirement is not reconsidered - PV might be pinned while it is being snapshotted.
+func retiringPolicy(_ context.Context, pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (Action, string) {
+	if reason, ok := pv.ObjectMeta.Annotations[AnnotationRetiring]; ok {
+		return ActionRetire, reason
+	}
+	return ActionContinue, ""
+}
+
+func (r *Releaser) pvRetireHandler(pv *corev1.PersistentVolume, sc *storagev1.StorageClass, reason string) error {
+	_, pinned := pv.ObjectMeta.Annotations[AnnotationOriginalClaim]
+	if pv.Status.Phase == corev1.VolumeBound && !pinned {
+		klog.V(4).Infof("PV %s is '%s', can't retire it yet", pv.ObjectMeta.Name, pv.Status.Phase)
+		return nil
+	}
+
+	if _, ok := pv.ObjectMeta.Annotations[AnnotationRetiring]; !ok {
+		pvCopy := pv.DeepCopy()
+		if pvCopy.ObjectMeta.Annotations == nil {
+			pvCopy.ObjectMeta.Annotations = make(map[string]string)
+		}
+		pvCopy.ObjectMeta.Annotations[AnnotationRetiring] = reason
+		_, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{})
+		if err != nil && !errors.IsConflict(err) {
+			return err
+		}
+		// It will be queued again with a new version
+		return nil
+	}
+
+	// Other helpers must let go of the PV first, snapshot helper is managed by snapshotBeforeRetire
+	if pinned && pv.Status.Phase == corev1.VolumeBound && pv.Spec.ClaimRef.Name != helperName(snapshotHelperPrefix, pv.ObjectMeta.Name) {
+		unpinning, err := r.unpinAny(pv)
+		if err != nil {
+			r.Recorder.Event(
+				pv,
+				corev1.EventTypeWarning,
+				ErrRetirePV,
+				fmt.Sprintf(MessageRetirePV, pv.ObjectMeta.Name, err),
+			)
+			return err
+		}
+		if unpinning {
+			klog.V(4).Infof("PV %q will be checked again in %s: waiting for helper PVC to be deleted", pv.ObjectMeta.Name, r.WaitInterval)
+			r.PVQueue.AddAfter(pv.ObjectMeta.Name, r.WaitInterval)
+			return nil
+		}
+	}
+
+	done, waitReason, err := r.snapshotBeforeRetire(pv, sc)
+	if err != nil {
+		r.Recorder.Event(
+			pv,
+			corev1.EventTypeWarning,
+			ErrRetirePV,
+			fmt.Sprintf(MessageRetirePV, pv.ObjectMeta.Name, err),
+		)
+		return err
+	}
+	if !done {
+		klog.V(4).Infof("PV %q will be checked again in %s: %s", pv.ObjectMeta.Name, r.WaitInterval, waitReason)
+		r.PVQueue.AddAfter(pv.ObjectMeta.Name, r.WaitInterval)
+		return nil
+	}
+
+	if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimDelete {
+		pvCopy := pv.DeepCopy()
+		pvCopy.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimDelete
+		updated, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{})
+		if err != nil {
+			if errors.IsConflict(err) {
+				klog.V(4).Infof("PV %s had a conflict - ignore it, it will be queued again with a new version", pv.ObjectMeta.Name)
+				return nil
+			}
+
+			r.Recorder.Event(
+				pvCopy,
+				corev1.EventTypeWarning,
+				ErrRetirePV,
+				fmt.Sprintf(MessageRetirePV, pvCopy.ObjectMeta.Name, err),
+			)
+			return err
+		}
+		pv = updated
+	} else if pv.Status.Phase != corev1.VolumeAvailable {
+		klog.V(6).Infof("PV %s is already retired - moving on", pv.ObjectMeta.Name)
+		return nil
+	}
+
+	// Released PVs are going to be deleted by Kubernetes now, but nothing will reclaim an Available PV
+	if pv.Status.Phase == corev1.VolumeAvailable && pv.ObjectMeta.DeletionTimestamp == nil {
+		err := r.KubeClientSet.CoreV1().PersistentVolumes().Delete(r.Ctx, pv.ObjectMeta.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			r.Recorder.Event(
+				pv,
+				corev1.EventTypeWarning,
+				ErrRetirePV,
+				fmt.Sprintf(MessageRetirePV, pv.ObjectMeta.Name, err),
+			)
+			return err
+		}
+	}
+
+	r.Recorder.Event(pv, corev1.EventTypeNormal, Retired, fmt.Sprintf(MessagePVRetired, reason))
+	return nil
+}
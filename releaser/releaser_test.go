@@ -0,0 +1,63 @@
+package releaser
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRetiringPolicy(t *testing.T) {
+	policies := []ReleasePolicy{&ControllerIdPolicy{ControllerId: "test"}, PolicyFunc(retiringPolicy)}
+	retiring := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pv",
+		Annotations: map[string]string{AnnotationRetiring: "draining"},
+	}}
+	pooled := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}}
+
+	tests := []struct {
+		name         string
+		pv           *corev1.PersistentVolume
+		controllerId string
+		want         Action
+		wantReason   string
+	}{
+		{
+			name:         "retiring",
+			pv:           retiring,
+			controllerId: "test",
+			want:         ActionRetire,
+			wantReason:   "draining",
+		},
+		{
+			name:         "retiring in a Storage Class of another controller",
+			pv:           retiring,
+			controllerId: "other",
+			want:         ActionSkip,
+		},
+		{
+			name:         "not retiring",
+			pv:           pooled,
+			controllerId: "test",
+			want:         ActionRelease,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+				Name:        "pool",
+				Annotations: map[string]string{AnnotationControllerId: test.controllerId},
+			}}
+			action, reason := Decide(context.Background(), policies, test.pv, sc)
+			if action != test.want {
+				t.Errorf("expected %s, got %s: %s", test.want, action, reason)
+			}
+			if test.wantReason != "" && reason != test.wantReason {
+				t.Errorf("expected reason %q, got %q", test.wantReason, reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package releaser
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// Reservations let consumers outside of the cluster (or schedulers ahead of a pod) hold a pooled PV.
+// A reservation is a claimRef pre-bind recorded in PV annotations, so it survives leader failover.
+const (
+	// PV annotations
+	AnnotationReservationIdKey       = pool.AnnotationReservationIdKey
+	AnnotationReservationId          = pool.AnnotationReservationId
+	AnnotationReservationExpiresKey  = "reservation-expires"
+	AnnotationReservationExpires     = AnnotationBaseName + "/" + AnnotationReservationExpiresKey
+	AnnotationReservationCacheKeyKey = "reservation-cache-key"
+	AnnotationReservationCacheKey    = AnnotationBaseName + "/" + AnnotationReservationCacheKeyKey
+
+	DefaultReservationTTL = time.Hour
+	MaxReservationTTL     = 24 * time.Hour
+
+	// maxReservationRequestSize limits request bodies, a valid request is well under it
+	maxReservationRequestSize = 64 << 10
+
+	Reserved          = "Reserved"
+	MessagePVReserved = "PV reserved for %s/%s until %s"
+
+	ReservationExpired          = "ReservationExpired"
+	MessagePVReservationExpired = "PV reservation %s expired"
+)
+
+// ReservationConfig configures the reservation API server.
+type ReservationConfig struct {
+	// Addr to listen on, i.e. ":8443".
+	Addr string
+	// TokenFile contains a bearer token clients must present.
+	TokenFile string
+	// CertFile and KeyFile enable TLS.
+	CertFile string
+	KeyFile  string
+	// Namespaces claims of reserved PVs may be in, the API can't pre-bind PVs to claims elsewhere.
+	Namespaces []string
+}
+
+// WithReservationAPI makes Releaser serve the reservation API while it is running.
+func WithReservationAPI(config ReservationConfig) Option {
+	return func(r *Releaser) {
+		r.ReservationConfig = &config
+	}
+}
+
+// ReservationClaim is a PVC the reserved PV is pre-bound to.
+type ReservationClaim struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// ReservationRequest is a body of a reserve or renew call.
+type ReservationRequest struct {
+	StorageClass string            `json:"storageClass,omitempty"`
+	CacheKey     string            `json:"cacheKey,omitempty"`
+	TTL          string            `json:"ttl,omitempty"`
+	Claim        *ReservationClaim `json:"claim,omitempty"`
+}
+
+// Reservation is what the API returns.
+type Reservation struct {
+	Id               string            `json:"id"`
+	PersistentVolume string            `json:"persistentVolume"`
+	StorageClass     string            `json:"storageClass"`
+	CacheKey         string            `json:"cacheKey,omitempty"`
+	Claim            *ReservationClaim `json:"claim"`
+	ExpiresAt        time.Time         `json:"expiresAt"`
+	Bound            bool              `json:"bound"`
+}
+
+type reservationError struct {
+	Error string `json:"error"`
+}
+
+func reservationOf(pv *corev1.PersistentVolume) *Reservation {
+	id, ok := pv.ObjectMeta.Annotations[AnnotationReservationId]
+	if !ok {
+		return nil
+	}
+	reservation := &Reservation{
+		Id:               id,
+		PersistentVolume: pv.ObjectMeta.Name,
+		StorageClass:     pv.Spec.StorageClassName,
+		CacheKey:         pv.ObjectMeta.Annotations[AnnotationReservationCacheKey],
+		Bound:            pv.Status.Phase == corev1.VolumeBound,
+	}
+	if pv.Spec.ClaimRef != nil {
+		reservation.Claim = &ReservationClaim{Namespace: pv.Spec.ClaimRef.Namespace, Name: pv.Spec.ClaimRef.Name}
+	}
+	if expires, err := time.Parse(time.RFC3339, pv.ObjectMeta.Annotations[AnnotationReservationExpires]); err == nil {
+		reservation.ExpiresAt = expires
+	}
+	return reservation
+}
+
+func parseReservationTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return DefaultReservationTTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 || ttl > MaxReservationTTL {
+		return 0, fmt.Errorf("ttl must be positive and no longer than %s", MaxReservationTTL)
+	}
+	return ttl, nil
+}
+
+// reservationPolicy keeps reserved PVs alone until the reservation is consumed or expires.
+func (r *Releaser) reservationPolicy(_ context.Context, pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (Action, string) {
+	reservation := reservationOf(pv)
+	if reservation == nil || pv.Status.Phase != corev1.VolumeAvailable {
+		return ActionContinue, ""
+	}
+	if time.Now().Before(reservation.ExpiresAt) {
+		return ActionWait, fmt.Sprintf("reserved by %s until %s", reservation.Id, reservation.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if _, err := r.unreserve(pv); err != nil {
+		return ActionWait, fmt.Sprintf("failed to expire reservation %s: %s", reservation.Id, err)
+	}
+	r.Recorder.Event(pv, corev1.EventTypeNormal, ReservationExpired, fmt.Sprintf(MessagePVReservationExpired, reservation.Id))
+	return ActionSkip, "reservation expired"
+}
+
+// unreserve drops the reservation, and the pre-bind unless the claim is already Bound.
+// Cache key is kept, so the next reservation with the same key lands on this PV.
+func (r *Releaser) unreserve(pv *corev1.PersistentVolume) (*corev1.PersistentVolume, error) {
+	pvCopy := pv.DeepCopy()
+	delete(pvCopy.ObjectMeta.Annotations, AnnotationReservationId)
+	delete(pvCopy.ObjectMeta.Annotations, AnnotationReservationExpires)
+	if pvCopy.Status.Phase != corev1.VolumeBound {
+		pvCopy.Spec.ClaimRef = nil
+	}
+	return r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{})
+}
+
+// reserve pre-binds a free PV of the Storage Class to the claim.
+// PVs last reserved with the same cache key are preferred.
+func (r *Releaser) reserve(request *ReservationRequest, ttl time.Duration) (*corev1.PersistentVolume, error) {
+	sc, err := r.SCLister.Get(request.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+	if sc.ObjectMeta.Annotations[AnnotationControllerId] != r.ControllerId {
+		return nil, fmt.Errorf("SC %s is not associated with this controller ID", sc.ObjectMeta.Name)
+	}
+	if isDraining(sc) {
+		return nil, fmt.Errorf("SC %s is draining", sc.ObjectMeta.Name)
+	}
+
+	pvs, err := r.PVLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	candidates := []*corev1.PersistentVolume{}
+	for _, pv := range pvs {
+		if pv.Spec.StorageClassName != sc.ObjectMeta.Name || pv.Status.Phase != corev1.VolumeAvailable || pv.Spec.ClaimRef != nil {
+			continue
+		}
+		if _, ok := pv.ObjectMeta.Annotations[AnnotationRetiring]; ok || pv.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if request.CacheKey != "" && pv.ObjectMeta.Annotations[AnnotationReservationCacheKey] == request.CacheKey {
+			candidates = append([]*corev1.PersistentVolume{pv}, candidates...)
+			continue
+		}
+		candidates = append(candidates, pv)
+	}
+
+	id := uuid.New().String()
+	expires := time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	for _, pv := range candidates {
+		pvCopy := pv.DeepCopy()
+		if pvCopy.ObjectMeta.Annotations == nil {
+			pvCopy.ObjectMeta.Annotations = make(map[string]string)
+		}
+		pvCopy.ObjectMeta.Annotations[AnnotationReservationId] = id
+		pvCopy.ObjectMeta.Annotations[AnnotationReservationExpires] = expires
+		if request.CacheKey != "" {
+			pvCopy.ObjectMeta.Annotations[AnnotationReservationCacheKey] = request.CacheKey
+		}
+		pvCopy.Spec.ClaimRef = &corev1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  request.Claim.Namespace,
+			Name:       request.Claim.Name,
+		}
+		updated, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{})
+		if err != nil {
+			if errors.IsConflict(err) {
+				continue
+			}
+			return nil, err
+		}
+		r.Recorder.Event(updated, corev1.EventTypeNormal, Reserved, fmt.Sprintf(MessagePVReserved, request.Claim.Namespace, request.Claim.Name, expires))
+		return updated, nil
+	}
+	return nil, nil
+}
+
+func (r *Releaser) findReservation(id string) (*corev1.PersistentVolume, error) {
+	pvs, err := r.PVLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, pv := range pvs {
+		if pv.ObjectMeta.Annotations[AnnotationReservationId] == id {
+			return pv, nil
+		}
+	}
+	return nil, nil
+}
+
+// serveReservations runs the reservation API until stopCh is closed.
+func (r *Releaser) serveReservations(stopCh <-chan struct{}) error {
+	config := r.ReservationConfig
+	token, err := os.ReadFile(config.TokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read reservation API token: %w", err)
+	}
+	expected := []byte(strings.TrimSpace(string(token)))
+	if len(expected) == 0 {
+		return fmt.Errorf("reservation API token file %s is empty", config.TokenFile)
+	}
+	if len(config.Namespaces) == 0 {
+		return fmt.Errorf("reservation API requires at least one namespace claims are allowed in")
+	}
+
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           r.reservationHandler(expected),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Warningf("Failed to shut down reservation API: %s", err)
+		}
+	}()
+
+	go func() {
+		klog.Infof("Serving reservation API on %s", config.Addr)
+		var err error
+		if config.CertFile != "" {
+			err = server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Reservation API failed: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// reservationHandler routes reservation API calls presenting the token.
+func (r *Releaser) reservationHandler(token []byte) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/reservations", r.handleReserve)
+	mux.HandleFunc("GET /v1/reservations/{id}", r.handleGetReservation)
+	mux.HandleFunc("POST /v1/reservations/{id}/renew", r.handleRenewReservation)
+	mux.HandleFunc("DELETE /v1/reservations/{id}", r.handleReleaseReservation)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		presented := []byte(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		if subtle.ConstantTimeCompare(presented, token) != 1 {
+			writeReservationJSON(w, http.StatusUnauthorized, reservationError{Error: "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// claimNamespaceAllowed returns true if reserved PVs can be pre-bound to claims in the namespace.
+func (r *Releaser) claimNamespaceAllowed(namespace string) bool {
+	for _, allowed := range r.ReservationConfig.Namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Releaser) handleReserve(w http.ResponseWriter, req *http.Request) {
+	request := &ReservationRequest{}
+	body := http.MaxBytesReader(w, req.Body, maxReservationRequestSize)
+	if err := json.NewDecoder(body).Decode(request); err != nil {
+		writeReservationJSON(w, http.StatusBadRequest, reservationError{Error: err.Error()})
+		return
+	}
+	if request.StorageClass == "" || request.Claim == nil || request.Claim.Namespace == "" || request.Claim.Name == "" {
+		writeReservationJSON(w, http.StatusBadRequest, reservationError{Error: "storageClass, claim.namespace and claim.name are required"})
+		return
+	}
+	if !r.claimNamespaceAllowed(request.Claim.Namespace) {
+		writeReservationJSON(w, http.StatusForbidden, reservationError{Error: fmt.Sprintf("PVs can't be reserved for claims in namespace %s", request.Claim.Namespace)})
+		return
+	}
+	ttl, err := parseReservationTTL(request.TTL)
+	if err != nil {
+		writeReservationJSON(w, http.StatusBadRequest, reservationError{Error: err.Error()})
+		return
+	}
+
+	pv, err := r.reserve(request, ttl)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.IsNotFound(err) {
+			status = http.StatusNotFound
+		}
+		writeReservationJSON(w, status, reservationError{Error: err.Error()})
+		return
+	}
+	if pv == nil {
+		writeReservationJSON(w, http.StatusConflict, reservationError{Error: "no Available PVs in the pool"})
+		return
+	}
+	klog.V(4).Infof("Reserved PV %s for %s/%s", pv.ObjectMeta.Name, request.Claim.Namespace, request.Claim.Name)
+	writeReservationJSON(w, http.StatusCreated, reservationOf(pv))
+}
+
+func (r *Releaser) handleGetReservation(w http.ResponseWriter, req *http.Request) {
+	pv, ok := r.reservationFromPath(w, req)
+	if !ok {
+		return
+	}
+	writeReservationJSON(w, http.StatusOK, reservationOf(pv))
+}
+
+func (r *Releaser) handleRenewReservation(w http.ResponseWriter, req *http.Request) {
+	pv, ok := r.reservationFromPath(w, req)
+	if !ok {
+		return
+	}
+	request := &ReservationRequest{}
+	if req.ContentLength != 0 {
+		body := http.MaxBytesReader(w, req.Body, maxReservationRequestSize)
+		if err := json.NewDecoder(body).Decode(request); err != nil {
+			writeReservationJSON(w, http.StatusBadRequest, reservationError{Error: err.Error()})
+			return
+		}
+	}
+	ttl, err := parseReservationTTL(request.TTL)
+	if err != nil {
+		writeReservationJSON(w, http.StatusBadRequest, reservationError{Error: err.Error()})
+		return
+	}
+
+	pvCopy := pv.DeepCopy()
+	pvCopy.ObjectMeta.Annotations[AnnotationReservationExpires] = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	updated, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.IsConflict(err) {
+			status = http.StatusConflict
+		}
+		writeReservationJSON(w, status, reservationError{Error: err.Error()})
+		return
+	}
+	writeReservationJSON(w, http.StatusOK, reservationOf(updated))
+}
+
+func (r *Releaser) handleReleaseReservation(w http.ResponseWriter, req *http.Request) {
+	pv, ok := r.reservationFromPath(w, req)
+	if !ok {
+		return
+	}
+	if _, err := r.unreserve(pv); err != nil {
+		status := http.StatusInternalServerError
+		if errors.IsConflict(err) {
+			status = http.StatusConflict
+		}
+		writeReservationJSON(w, status, reservationError{Error: err.Error()})
+		return
+	}
+	klog.V(4).Infof("Released reservation %s of PV %s", pv.ObjectMeta.Annotations[AnnotationReservationId], pv.ObjectMeta.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Releaser) reservationFromPath(w http.ResponseWriter, req *http.Request) (*corev1.PersistentVolume, bool) {
+	id := req.PathValue("id")
+	pv, err := r.findReservation(id)
+	if err != nil {
+		writeReservationJSON(w, http.StatusInternalServerError, reservationError{Error: err.Error()})
+		return nil, false
+	}
+	if pv == nil {
+		writeReservationJSON(w, http.StatusNotFound, reservationError{Error: fmt.Sprintf("reservation %s not found", id)})
+		return nil, false
+	}
+	return pv, true
+}
+
+func writeReservationJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		klog.Warningf("Failed to write reservation API response: %s", err)
+	}
+}
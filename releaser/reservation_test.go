@@ -0,0 +1,278 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const reservationTestToken = "secret"
+
+func reservationTestPV(name, storageClass string, annotations map[string]string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Spec:       corev1.PersistentVolumeSpec{StorageClassName: storageClass},
+		Status:     corev1.PersistentVolumeStatus{Phase: corev1.VolumeAvailable},
+	}
+}
+
+// reservationTestServer serves the reservation API of a Releaser that sees the objects both in its caches and the API.
+func reservationTestServer(t *testing.T, objects ...runtime.Object) (*httptest.Server, *fake.Clientset) {
+	t.Helper()
+	pvs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	scs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, obj := range objects {
+		switch obj.(type) {
+		case *corev1.PersistentVolume:
+			_ = pvs.Add(obj)
+		case *storagev1.StorageClass:
+			_ = scs.Add(obj)
+		}
+	}
+	client := fake.NewSimpleClientset(objects...)
+
+	r := &Releaser{
+		BasicController: controller.BasicController{
+			Ctx:           context.Background(),
+			ControllerId:  "test",
+			KubeClientSet: client,
+			Recorder:      record.NewFakeRecorder(10),
+		},
+		SCLister:          storagelisters.NewStorageClassLister(scs),
+		PVLister:          corelisters.NewPersistentVolumeLister(pvs),
+		ReservationConfig: &ReservationConfig{Namespaces: []string{"ci"}},
+	}
+	server := httptest.NewServer(r.reservationHandler([]byte(reservationTestToken)))
+	t.Cleanup(server.Close)
+	return server, client
+}
+
+func reservationTestCall(t *testing.T, server *httptest.Server, method, path, token, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestReservationAuth(t *testing.T) {
+	server, _ := reservationTestServer(t)
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "no token", want: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "token without scheme", header: reservationTestToken + "x", want: http.StatusUnauthorized},
+		{name: "valid token", header: "Bearer " + reservationTestToken, want: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/reservations/missing", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want {
+				t.Errorf("expected %d, got %d", test.want, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestHandleReserve(t *testing.T) {
+	pool := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pool",
+		Annotations: map[string]string{AnnotationControllerId: "test"},
+	}}
+	draining := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+		Name:        "draining",
+		Annotations: map[string]string{AnnotationControllerId: "test", AnnotationDrain: "true"},
+	}}
+	foreign := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+		Name:        "foreign",
+		Annotations: map[string]string{AnnotationControllerId: "other"},
+	}}
+	empty := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+		Name:        "empty",
+		Annotations: map[string]string{AnnotationControllerId: "test"},
+	}}
+	preBound := reservationTestPV("pre-bound", "pool", nil)
+	preBound.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "ci", Name: "other"}
+
+	tests := []struct {
+		name   string
+		body   string
+		want   int
+		wantPV string
+	}{
+		{
+			name: "invalid body",
+			body: "{",
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "missing claim",
+			body: `{"storageClass": "pool"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "namespace not allowed",
+			body: `{"storageClass": "pool", "claim": {"namespace": "kube-system", "name": "build"}}`,
+			want: http.StatusForbidden,
+		},
+		{
+			name: "invalid ttl",
+			body: `{"storageClass": "pool", "ttl": "48h", "claim": {"namespace": "ci", "name": "build"}}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown storage class",
+			body: `{"storageClass": "missing", "claim": {"namespace": "ci", "name": "build"}}`,
+			want: http.StatusNotFound,
+		},
+		{
+			name: "storage class of another controller",
+			body: `{"storageClass": "foreign", "claim": {"namespace": "ci", "name": "build"}}`,
+			want: http.StatusInternalServerError,
+		},
+		{
+			name: "draining storage class",
+			body: `{"storageClass": "draining", "claim": {"namespace": "ci", "name": "build"}}`,
+			want: http.StatusInternalServerError,
+		},
+		{
+			name: "no available PVs",
+			body: `{"storageClass": "empty", "claim": {"namespace": "ci", "name": "build"}}`,
+			want: http.StatusConflict,
+		},
+		{
+			name:   "prefers the cache key",
+			body:   `{"storageClass": "pool", "cacheKey": "maven", "claim": {"namespace": "ci", "name": "build"}}`,
+			want:   http.StatusCreated,
+			wantPV: "maven",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := reservationTestServer(t,
+				pool, draining, foreign, empty,
+				preBound,
+				reservationTestPV("reserved", "pool", map[string]string{AnnotationReservationId: "other"}),
+				reservationTestPV("free", "pool", nil),
+				reservationTestPV("maven", "pool", map[string]string{AnnotationReservationCacheKey: "maven"}),
+				reservationTestPV("retiring", "empty", map[string]string{AnnotationRetiring: "true"}),
+			)
+			resp := reservationTestCall(t, server, http.MethodPost, "/v1/reservations", reservationTestToken, test.body)
+			if resp.StatusCode != test.want {
+				t.Fatalf("expected %d, got %d", test.want, resp.StatusCode)
+			}
+			if test.wantPV == "" {
+				return
+			}
+
+			reservation := &Reservation{}
+			if err := json.NewDecoder(resp.Body).Decode(reservation); err != nil {
+				t.Fatal(err)
+			}
+			if reservation.PersistentVolume != test.wantPV {
+				t.Errorf("expected PV %s, got %s", test.wantPV, reservation.PersistentVolume)
+			}
+			pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), test.wantPV, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != "ci" || pv.Spec.ClaimRef.Name != "build" {
+				t.Errorf("expected PV pre-bound to ci/build, got %v", pv.Spec.ClaimRef)
+			}
+			if pv.ObjectMeta.Annotations[AnnotationReservationId] != reservation.Id {
+				t.Errorf("expected reservation %s recorded on the PV, got %q", reservation.Id, pv.ObjectMeta.Annotations[AnnotationReservationId])
+			}
+		})
+	}
+}
+
+func TestReservationLifecycle(t *testing.T) {
+	expires := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	reserved := reservationTestPV("reserved", "pool", map[string]string{
+		AnnotationReservationId:      "id",
+		AnnotationReservationExpires: expires,
+	})
+	reserved.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "ci", Name: "build"}
+	server, client := reservationTestServer(t, reserved)
+
+	resp := reservationTestCall(t, server, http.MethodGet, "/v1/reservations/id", reservationTestToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get: expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	reservation := &Reservation{}
+	if err := json.NewDecoder(resp.Body).Decode(reservation); err != nil {
+		t.Fatal(err)
+	}
+	if reservation.PersistentVolume != "reserved" || reservation.Claim == nil || reservation.Claim.Name != "build" {
+		t.Errorf("get: unexpected reservation %+v", reservation)
+	}
+
+	resp = reservationTestCall(t, server, http.MethodPost, "/v1/reservations/id/renew", reservationTestToken, `{"ttl": "2h"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("renew: expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(reservation); err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(reservation.ExpiresAt) < time.Hour {
+		t.Errorf("renew: expected expiry in 2h, got %s", reservation.ExpiresAt)
+	}
+
+	resp = reservationTestCall(t, server, http.MethodDelete, "/v1/reservations/id", reservationTestToken, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("release: expected %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), "reserved", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pv.ObjectMeta.Annotations[AnnotationReservationId]; ok || pv.Spec.ClaimRef != nil {
+		t.Errorf("release: expected reservation and pre-bind dropped, got %v and %v", pv.ObjectMeta.Annotations, pv.Spec.ClaimRef)
+	}
+
+	resp = reservationTestCall(t, server, http.MethodGet, "/v1/reservations/missing", reservationTestToken, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get missing: expected %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,189 @@
+package releaser
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers/pool"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Storage Class annotations
+	AnnotationSnapshotClassKey  = "snapshot-class"
+	AnnotationSnapshotClass     = AnnotationBaseName + "/" + AnnotationSnapshotClassKey
+	AnnotationSnapshotRetainKey = "snapshot-retain"
+	AnnotationSnapshotRetain    = AnnotationBaseName + "/" + AnnotationSnapshotRetainKey
+
+	// PV annotations
+	AnnotationSnapshotKey = "snapshot"
+	AnnotationSnapshot    = AnnotationBaseName + "/" + AnnotationSnapshotKey
+
+	LabelStorageClassKey = pool.LabelStorageClassKey
+	LabelStorageClass    = pool.LabelStorageClass
+	LabelSnapshotKey     = pool.LabelSnapshotKey
+	LabelSnapshot        = pool.LabelSnapshot
+
+	SnapshotRetired = "retired"
+
+	DefaultSnapshotRetain = 3
+
+	snapshotHelperPrefix = "snapshot"
+	retiredPrefix        = "retired"
+
+	Snapshotted          = "Snapshotted"
+	MessagePVSnapshotted = "PV snapshotted to %s/%s"
+
+	MessageSnapshotPV = "error snapshotting PV: %s"
+	ErrSnapshotPV     = "ErrSnapshotPV"
+)
+
+var VolumeSnapshotResource = pool.VolumeSnapshotResource
+
+// WithDynamicClient sets a client to work with optional CRDs such as VolumeSnapshots.
+func WithDynamicClient(client dynamic.Interface) Option {
+	return func(r *Releaser) {
+		r.DynamicClient = client
+	}
+}
+
+// snapshotBeforeRetire takes a VolumeSnapshot of the PV if its Storage Class opted in.
+// It returns true when the PV is ready to be retired, otherwise a reason to wait.
+func (r *Releaser) snapshotBeforeRetire(pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (bool, string, error) {
+	snapshotClass, ok := sc.ObjectMeta.Annotations[AnnotationSnapshotClass]
+	if !ok {
+		return true, "", nil
+	}
+	if r.HelperNamespace == "" || r.DynamicClient == nil {
+		return false, "", fmt.Errorf("SC %s requires a snapshot, but helper namespace or dynamic client is not configured", sc.ObjectMeta.Name)
+	}
+
+	if _, ok := pv.ObjectMeta.Annotations[AnnotationSnapshot]; !ok {
+		pvc, err := r.pinPV(pv, sc, snapshotHelperPrefix, r.HelperNamespace)
+		if err != nil {
+			return false, "", err
+		}
+		if pvc.Status.Phase != corev1.ClaimBound {
+			return false, fmt.Sprintf("waiting for helper PVC %s/%s to bind", pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name), nil
+		}
+
+		name := helperName(retiredPrefix, pv.ObjectMeta.Name)
+		ready, err := r.snapshot(pv, sc, pvc, name, snapshotClass, SnapshotRetired)
+		if err != nil {
+			return false, "", err
+		}
+		if !ready {
+			return false, fmt.Sprintf("waiting for VolumeSnapshot %s/%s to be ready", r.HelperNamespace, name), nil
+		}
+
+		pvCopy := pv.DeepCopy()
+		pvCopy.ObjectMeta.Annotations[AnnotationSnapshot] = fmt.Sprintf("%s/%s", r.HelperNamespace, name)
+		if _, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{}); err != nil {
+			return false, "", err
+		}
+		r.Recorder.Event(pv, corev1.EventTypeNormal, Snapshotted, fmt.Sprintf(MessagePVSnapshotted, r.HelperNamespace, name))
+
+		retain := DefaultSnapshotRetain
+		if value, ok := sc.ObjectMeta.Annotations[AnnotationSnapshotRetain]; ok {
+			if retain, err = strconv.Atoi(value); err != nil || retain < 1 {
+				klog.Warningf("SC %s has invalid %s %q, using %d", sc.ObjectMeta.Name, AnnotationSnapshotRetain, value, DefaultSnapshotRetain)
+				retain = DefaultSnapshotRetain
+			}
+		}
+		if err := r.pruneSnapshots(r.HelperNamespace, sc, SnapshotRetired, retain); err != nil {
+			klog.Warningf("Failed to prune old snapshots of SC %s: %s", sc.ObjectMeta.Name, err)
+		}
+		return false, "snapshot recorded", nil
+	}
+
+	unpinning, err := r.unpinPV(pv, snapshotHelperPrefix, r.HelperNamespace)
+	if err != nil {
+		return false, "", err
+	}
+	if unpinning {
+		return false, "waiting for helper PVC to be deleted", nil
+	}
+	return true, "", nil
+}
+
+// snapshot makes sure a VolumeSnapshot of the helper PVC exists and returns whether it is ready to use.
+func (r *Releaser) snapshot(
+	pv *corev1.PersistentVolume,
+	sc *storagev1.StorageClass,
+	pvc *corev1.PersistentVolumeClaim,
+	name, snapshotClass, kind string,
+) (bool, error) {
+	snapshots := r.DynamicClient.Resource(VolumeSnapshotResource).Namespace(pvc.ObjectMeta.Namespace)
+
+	snapshot, err := snapshots.Get(r.Ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		snapshotLabels := r.helperLabels(pv)
+		snapshotLabels[LabelStorageClass] = sc.ObjectMeta.Name
+		snapshotLabels[LabelSnapshot] = kind
+
+		snapshot = &unstructured.Unstructured{}
+		snapshot.SetAPIVersion(VolumeSnapshotResource.GroupVersion().String())
+		snapshot.SetKind("VolumeSnapshot")
+		snapshot.SetName(name)
+		snapshot.SetNamespace(pvc.ObjectMeta.Namespace)
+		snapshot.SetLabels(snapshotLabels)
+		if err := unstructured.SetNestedField(snapshot.Object, snapshotClass, "spec", "volumeSnapshotClassName"); err != nil {
+			return false, err
+		}
+		if err := unstructured.SetNestedField(snapshot.Object, pvc.ObjectMeta.Name, "spec", "source", "persistentVolumeClaimName"); err != nil {
+			return false, err
+		}
+
+		snapshot, err = snapshots.Create(r.Ctx, snapshot, metav1.CreateOptions{})
+		if err != nil {
+			return false, err
+		}
+		klog.V(4).Infof("Created VolumeSnapshot %s/%s for PV %s", pvc.ObjectMeta.Namespace, name, pv.ObjectMeta.Name)
+	} else if err != nil {
+		return false, err
+	}
+
+	if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found && message != "" {
+		r.Recorder.Event(pv, corev1.EventTypeWarning, ErrSnapshotPV, fmt.Sprintf(MessageSnapshotPV, message))
+	}
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	return ready, nil
+}
+
+// pruneSnapshots keeps only the latest retain snapshots of the kind for the SC.
+func (r *Releaser) pruneSnapshots(namespace string, sc *storagev1.StorageClass, kind string, retain int) error {
+	snapshots := r.DynamicClient.Resource(VolumeSnapshotResource).Namespace(namespace)
+
+	list, err := snapshots.List(r.Ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			LabelManagedBy:    r.ControllerId,
+			LabelStorageClass: sc.ObjectMeta.Name,
+			LabelSnapshot:     kind,
+		}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	items := list.Items
+	sort.Slice(items, func(i, j int) bool {
+		ti, tj := items[i].GetCreationTimestamp(), items[j].GetCreationTimestamp()
+		return tj.Before(&ti)
+	})
+	for i := retain; i < len(items); i++ {
+		name := items[i].GetName()
+		if err := snapshots.Delete(r.Ctx, name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		klog.V(4).Infof("Deleted old VolumeSnapshot %s/%s of SC %s", namespace, name, sc.ObjectMeta.Name)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Storage Class annotations
+	AnnotationUsageMaxBytesKey  = "usage-max-bytes"
+	AnnotationUsageMaxBytes     = AnnotationBaseName + "/" + AnnotationUsageMaxBytesKey
+	AnnotationUsageMaxInodesKey = "usage-max-inodes"
+	AnnotationUsageMaxInodes    = AnnotationBaseName + "/" + AnnotationUsageMaxInodesKey
+	AnnotationUsageActionKey    = "usage-action"
+	AnnotationUsageAction       = AnnotationBaseName + "/" + AnnotationUsageActionKey
+	AnnotationPruneJobKey       = "prune-job"
+	AnnotationPruneJob          = AnnotationBaseName + "/" + AnnotationPruneJobKey
+
+	UsageActionRetire = "retire"
+	UsageActionPrune  = "prune"
+
+	// PV annotations
+	AnnotationUsageBytesKey    = "usage-bytes"
+	AnnotationUsageBytes       = AnnotationBaseName + "/" + AnnotationUsageBytesKey
+	AnnotationUsageInodesKey   = "usage-inodes"
+	AnnotationUsageInodes      = AnnotationBaseName + "/" + AnnotationUsageInodesKey
+	AnnotationUsageProbedAtKey = "usage-probed-at"
+	AnnotationUsageProbedAt    = AnnotationBaseName + "/" + AnnotationUsageProbedAtKey
+	AnnotationUsageClaimKey    = "usage-claim"
+	AnnotationUsageClaim       = AnnotationBaseName + "/" + AnnotationUsageClaimKey
+	AnnotationPrunedClaimKey   = "pruned-claim"
+	AnnotationPrunedClaim      = AnnotationBaseName + "/" + AnnotationPrunedClaimKey
+
+	usageHelperPrefix = "usage"
+	probeJobPrefix    = "probe"
+	pruneJobPrefix    = "prune"
+
+	Probed          = "Probed"
+	MessagePVProbed = "PV usage: %s bytes, %s inodes"
+
+	MessageProbePV = "error probing PV usage: %s"
+	ErrProbePV     = "ErrProbePV"
+
+	Pruned          = "Pruned"
+	MessagePVPruned = "PV pruned: %s"
+
+	MessagePrunePV = "error pruning PV: %s"
+	ErrPrunePV     = "ErrPrunePV"
+
+	// The probe reports used KiB and inodes of the volume file system via the termination message
+	probeScript = `set -e
+kib=$(df -Pk /data | tail -n 1 | awk '{print $3}')
+inodes=$(df -Pi /data | tail -n 1 | awk '{print $3}')
+echo "$kib $inodes" > /dev/termination-log`
+)
+
+type usageThresholds struct {
+	maxBytes  *resource.Quantity
+	maxInodes *int64
+	action    string
+}
+
+func parseUsageThresholds(sc *storagev1.StorageClass) (*usageThresholds, error) {
+	annotations := sc.ObjectMeta.Annotations
+	t := &usageThresholds{action: UsageActionRetire}
+
+	if value, ok := annotations[AnnotationUsageMaxBytes]; ok {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", AnnotationUsageMaxBytes, err)
+		}
+		t.maxBytes = &q
+	}
+	if value, ok := annotations[AnnotationUsageMaxInodes]; ok {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", AnnotationUsageMaxInodes, err)
+		}
+		t.maxInodes = &i
+	}
+	if t.maxBytes == nil && t.maxInodes == nil {
+		return nil, nil
+	}
+
+	if value, ok := annotations[AnnotationUsageAction]; ok {
+		switch value {
+		case UsageActionRetire, UsageActionPrune:
+			t.action = value
+		default:
+			return nil, fmt.Errorf("invalid %s: %q", AnnotationUsageAction, value)
+		}
+	}
+	if t.action == UsageActionPrune {
+		if _, ok := annotations[AnnotationPruneJob]; !ok {
+			return nil, fmt.Errorf("%s is %q but %s is missing", AnnotationUsageAction, UsageActionPrune, AnnotationPruneJob)
+		}
+	}
+
+	return t, nil
+}
+
+// exceeded checks usage recorded on the PV against the thresholds.
+func (t *usageThresholds) exceeded(pv *corev1.PersistentVolume) (bool, string) {
+	annotations := pv.ObjectMeta.Annotations
+	if t.maxBytes != nil {
+		if used, err := strconv.ParseInt(annotations[AnnotationUsageBytes], 10, 64); err == nil && used > t.maxBytes.Value() {
+			return true, fmt.Sprintf("used %d bytes is over %s", used, t.maxBytes.String())
+		}
+	}
+	if t.maxInodes != nil {
+		if used, err := strconv.ParseInt(annotations[AnnotationUsageInodes], 10, 64); err == nil && used > *t.maxInodes {
+			return true, fmt.Sprintf("used %d inodes is over %d", used, *t.maxInodes)
+		}
+	}
+	return false, ""
+}
+
+// WithHelperNamespace sets a namespace for helper PVCs and Jobs the Releaser creates to work with PV content.
+func WithHelperNamespace(namespace string) Option {
+	return func(r *Releaser) {
+		r.HelperNamespace = namespace
+	}
+}
+
+// WithProbeImage sets an image for the usage probe Jobs, it must have sh, df, tail and awk.
+func WithProbeImage(image string) Option {
+	return func(r *Releaser) {
+		r.ProbeImage = image
+	}
+}
+
+// usagePolicy probes Released PVs of Storage Classes that define usage thresholds,
+// and prunes or retires PVs that are over the thresholds.
+func (r *Releaser) usagePolicy(_ context.Context, pv *corev1.PersistentVolume, sc *storagev1.StorageClass) (Action, string) {
+	thresholds, err := parseUsageThresholds(sc)
+	if err != nil {
+		r.Recorder.Event(sc, corev1.EventTypeWarning, ErrProbePV, fmt.Sprintf(MessageProbePV, err))
+		return ActionSkip, err.Error()
+	}
+	if thresholds == nil {
+		return ActionContinue, ""
+	}
+	if r.HelperNamespace == "" {
+		klog.Warningf("SC %s defines usage thresholds, but -helper-namespace is not set - not probing PV %s", sc.ObjectMeta.Name, pv.ObjectMeta.Name)
+		return ActionContinue, ""
+	}
+
+	original := OriginalClaimRef(pv)
+	_, pinned := pv.ObjectMeta.Annotations[AnnotationOriginalClaim]
+	if original == nil || (pv.Status.Phase != corev1.VolumeReleased && !pinned) {
+		// Not Released and not pinned by us
+		return ActionContinue, ""
+	}
+	claim := string(original.UID)
+
+	probed := pv.ObjectMeta.Annotations[AnnotationUsageClaim] == claim
+	over, overReason := false, ""
+	if probed {
+		over, overReason = thresholds.exceeded(pv)
+	}
+	prune := over && thresholds.action == UsageActionPrune && pv.ObjectMeta.Annotations[AnnotationPrunedClaim] != claim
+
+	if !probed || prune {
+		pvc, err := r.pinPV(pv, sc, usageHelperPrefix, r.HelperNamespace)
+		if err != nil {
+			return ActionWait, fmt.Sprintf("failed to pin PV: %s", err)
+		}
+		if pvc.Status.Phase != corev1.ClaimBound {
+			return ActionWait, fmt.Sprintf("waiting for helper PVC %s/%s to bind", pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+		}
+
+		if !probed {
+			return r.probe(pv, pvc, claim)
+		}
+		return r.prune(pv, sc, pvc, claim, overReason)
+	}
+
+	unpinning, err := r.unpinPV(pv, usageHelperPrefix, r.HelperNamespace)
+	if err != nil {
+		return ActionWait, fmt.Sprintf("failed to unpin PV: %s", err)
+	}
+	if unpinning {
+		return ActionWait, "waiting for helper PVC to be deleted"
+	}
+
+	if over && thresholds.action == UsageActionRetire {
+		return ActionRetire, overReason
+	}
+	return ActionContinue, ""
+}
+
+func (r *Releaser) probe(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim, claim string) (Action, string) {
+	backoffLimit := int32(2)
+	job, err := r.runHelperJob(pv, pvc, probeJobPrefix, &batchv1.Job{
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "probe",
+							Image:   r.ProbeImage,
+							Command: []string{"sh", "-c", probeScript},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      HelperVolumeName,
+									MountPath: "/data",
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return ActionWait, fmt.Sprintf("failed to run probe Job: %s", err)
+	}
+
+	finished, succeeded := helperJobFinished(job)
+	if !finished {
+		return ActionWait, fmt.Sprintf("waiting for probe Job %s/%s", job.ObjectMeta.Namespace, job.ObjectMeta.Name)
+	}
+
+	bytes, inodes := "", ""
+	if succeeded {
+		message, err := r.helperJobMessage(job)
+		if err == nil {
+			bytes, inodes, err = parseProbeMessage(message)
+		}
+		if err != nil {
+			succeeded = false
+			r.Recorder.Event(pv, corev1.EventTypeWarning, ErrProbePV, fmt.Sprintf(MessageProbePV, err))
+		}
+	} else {
+		r.Recorder.Event(pv, corev1.EventTypeWarning, ErrProbePV, fmt.Sprintf(MessageProbePV, "probe Job failed"))
+	}
+
+	// Failed probe is still recorded for this claim, so we are not stuck probing it forever
+	pvCopy := pv.DeepCopy()
+	if pvCopy.ObjectMeta.Annotations == nil {
+		pvCopy.ObjectMeta.Annotations = make(map[string]string)
+	}
+	pvCopy.ObjectMeta.Annotations[AnnotationUsageClaim] = claim
+	if succeeded {
+		pvCopy.ObjectMeta.Annotations[AnnotationUsageBytes] = bytes
+		pvCopy.ObjectMeta.Annotations[AnnotationUsageInodes] = inodes
+		pvCopy.ObjectMeta.Annotations[AnnotationUsageProbedAt] = time.Now().UTC().Format(time.RFC3339)
+	}
+	if _, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{}); err != nil {
+		return ActionWait, fmt.Sprintf("failed to record usage: %s", err)
+	}
+	if err := r.deleteHelperJob(pv, probeJobPrefix, job.ObjectMeta.Namespace); err != nil {
+		klog.Warningf("Failed to delete probe Job %s/%s: %s", job.ObjectMeta.Namespace, job.ObjectMeta.Name, err)
+	}
+
+	if succeeded {
+		r.Recorder.Event(pv, corev1.EventTypeNormal, Probed, fmt.Sprintf(MessagePVProbed, bytes, inodes))
+	}
+	return ActionWait, "usage recorded"
+}
+
+func (r *Releaser) prune(pv *corev1.PersistentVolume, sc *storagev1.StorageClass, pvc *corev1.PersistentVolumeClaim, claim, reason string) (Action, string) {
+	decode := scheme.Codecs.UniversalDeserializer().Decode
+	obj, _, err := decode([]byte(sc.ObjectMeta.Annotations[AnnotationPruneJob]), nil, nil)
+	if err != nil {
+		r.Recorder.Event(sc, corev1.EventTypeWarning, ErrPrunePV, fmt.Sprintf(MessagePrunePV, err))
+		return ActionSkip, fmt.Sprintf("invalid %s: %s", AnnotationPruneJob, err)
+	}
+	template, ok := obj.(*batchv1.Job)
+	if !ok {
+		r.Recorder.Event(sc, corev1.EventTypeWarning, ErrPrunePV, fmt.Sprintf(MessagePrunePV, fmt.Sprintf("expected job, got: %T", obj)))
+		return ActionSkip, fmt.Sprintf("invalid %s: expected job, got: %T", AnnotationPruneJob, obj)
+	}
+
+	job, err := r.runHelperJob(pv, pvc, pruneJobPrefix, template)
+	if err != nil {
+		return ActionWait, fmt.Sprintf("failed to run prune Job: %s", err)
+	}
+
+	finished, succeeded := helperJobFinished(job)
+	if !finished {
+		return ActionWait, fmt.Sprintf("waiting for prune Job %s/%s", job.ObjectMeta.Namespace, job.ObjectMeta.Name)
+	}
+	if !succeeded {
+		r.Recorder.Event(pv, corev1.EventTypeWarning, ErrPrunePV, fmt.Sprintf(MessagePrunePV, "prune Job failed"))
+	}
+
+	pvCopy := pv.DeepCopy()
+	pvCopy.ObjectMeta.Annotations[AnnotationPrunedClaim] = claim
+	if _, err := r.KubeClientSet.CoreV1().PersistentVolumes().Update(r.Ctx, pvCopy, metav1.UpdateOptions{}); err != nil {
+		return ActionWait, fmt.Sprintf("failed to record prune: %s", err)
+	}
+	if err := r.deleteHelperJob(pv, pruneJobPrefix, job.ObjectMeta.Namespace); err != nil {
+		klog.Warningf("Failed to delete prune Job %s/%s: %s", job.ObjectMeta.Namespace, job.ObjectMeta.Name, err)
+	}
+
+	if succeeded {
+		r.Recorder.Event(pv, corev1.EventTypeNormal, Pruned, fmt.Sprintf(MessagePVPruned, reason))
+	}
+	return ActionWait, "prune recorded"
+}
+
+func parseProbeMessage(message string) (string, string, error) {
+	fields := strings.Fields(message)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected probe output %q", message)
+	}
+	kib, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("unexpected probe output %q: %w", message, err)
+	}
+	inodes, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("unexpected probe output %q: %w", message, err)
+	}
+	return strconv.FormatInt(kib*1024, 10), strconv.FormatInt(inodes, 10), nil
+}
@@ -0,0 +1,275 @@
+package releaser
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	controller "github.com/plumber-cd/kubernetes-dynamic-reclaimable-pvc-controllers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func usageTestSC(annotations map[string]string) *storagev1.StorageClass {
+	return &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "pool", Annotations: annotations}}
+}
+
+func usageTestPV(annotations map[string]string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv", Annotations: annotations},
+		Spec: corev1.PersistentVolumeSpec{
+			StorageClassName: "pool",
+			ClaimRef:         &corev1.ObjectReference{Namespace: "default", Name: "cache", UID: "claim-uid"},
+		},
+		Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeReleased},
+	}
+}
+
+func TestParseUsageThresholds(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantNil     bool
+		wantAction  string
+		wantErr     bool
+	}{
+		{
+			name:    "no thresholds",
+			wantNil: true,
+		},
+		{
+			name:        "action alone is not a threshold",
+			annotations: map[string]string{AnnotationUsageAction: UsageActionPrune},
+			wantNil:     true,
+		},
+		{
+			name:        "retire by default",
+			annotations: map[string]string{AnnotationUsageMaxBytes: "10Gi"},
+			wantAction:  UsageActionRetire,
+		},
+		{
+			name: "prune",
+			annotations: map[string]string{
+				AnnotationUsageMaxInodes: "1000",
+				AnnotationUsageAction:    UsageActionPrune,
+				AnnotationPruneJob:       "{}",
+			},
+			wantAction: UsageActionPrune,
+		},
+		{
+			name: "prune without a job",
+			annotations: map[string]string{
+				AnnotationUsageMaxBytes: "10Gi",
+				AnnotationUsageAction:   UsageActionPrune,
+			},
+			wantErr: true,
+		},
+		{
+			name:        "invalid bytes",
+			annotations: map[string]string{AnnotationUsageMaxBytes: "ten"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid inodes",
+			annotations: map[string]string{AnnotationUsageMaxInodes: "1k"},
+			wantErr:     true,
+		},
+		{
+			name: "invalid action",
+			annotations: map[string]string{
+				AnnotationUsageMaxBytes: "10Gi",
+				AnnotationUsageAction:   "delete",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thresholds, err := parseUsageThresholds(usageTestSC(test.annotations))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			if test.wantErr {
+				return
+			}
+			if (thresholds == nil) != test.wantNil {
+				t.Fatalf("expected nil %t, got %+v", test.wantNil, thresholds)
+			}
+			if thresholds != nil && thresholds.action != test.wantAction {
+				t.Errorf("expected action %s, got %s", test.wantAction, thresholds.action)
+			}
+		})
+	}
+}
+
+func TestUsageThresholdsExceeded(t *testing.T) {
+	thresholds, err := parseUsageThresholds(usageTestSC(map[string]string{
+		AnnotationUsageMaxBytes:  "1Ki",
+		AnnotationUsageMaxInodes: "100",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		bytes string
+		nodes string
+		want  bool
+	}{
+		{name: "not probed"},
+		{name: "under", bytes: "1000", nodes: "99"},
+		{name: "at the thresholds", bytes: "1024", nodes: "100"},
+		{name: "over bytes", bytes: "1025", nodes: "1", want: true},
+		{name: "over inodes", bytes: "1", nodes: "101", want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if test.bytes != "" {
+				annotations[AnnotationUsageBytes] = test.bytes
+			}
+			if test.nodes != "" {
+				annotations[AnnotationUsageInodes] = test.nodes
+			}
+			got, reason := thresholds.exceeded(usageTestPV(annotations))
+			if got != test.want {
+				t.Errorf("expected %t, got %t: %s", test.want, got, reason)
+			}
+			if got == (reason == "") {
+				t.Errorf("expected a reason only if exceeded, got %q", reason)
+			}
+		})
+	}
+}
+
+func TestParseProbeMessage(t *testing.T) {
+	bytes, inodes, err := parseProbeMessage("12 34\n")
+	if err != nil || bytes != "12288" || inodes != "34" {
+		t.Errorf("expected 12288 bytes and 34 inodes, got %q, %q, %v", bytes, inodes, err)
+	}
+	for _, message := range []string{"", "12", "12 34 56", "12 many"} {
+		if _, _, err := parseProbeMessage(message); err == nil {
+			t.Errorf("expected error for %q", message)
+		}
+	}
+}
+
+func TestUsagePolicy(t *testing.T) {
+	retire := map[string]string{AnnotationUsageMaxBytes: "1Ki"}
+	prune := map[string]string{
+		AnnotationUsageMaxBytes: "1Ki",
+		AnnotationUsageAction:   UsageActionPrune,
+		AnnotationPruneJob:      "{}",
+	}
+	probed := func(bytes string, extra ...string) map[string]string {
+		annotations := map[string]string{AnnotationUsageClaim: "claim-uid", AnnotationUsageBytes: bytes}
+		for i := 0; i+1 < len(extra); i += 2 {
+			annotations[extra[i]] = extra[i+1]
+		}
+		return annotations
+	}
+
+	tests := []struct {
+		name            string
+		sc              map[string]string
+		pv              map[string]string
+		phase           corev1.PersistentVolumePhase
+		helperNamespace string
+		want            Action
+		wantReason      string
+	}{
+		{
+			name:            "no thresholds",
+			helperNamespace: "helpers",
+			want:            ActionContinue,
+		},
+		{
+			name:            "invalid thresholds",
+			sc:              map[string]string{AnnotationUsageMaxBytes: "ten"},
+			helperNamespace: "helpers",
+			want:            ActionSkip,
+		},
+		{
+			name: "no helper namespace",
+			sc:   retire,
+			want: ActionContinue,
+		},
+		{
+			name:            "not released",
+			sc:              retire,
+			phase:           corev1.VolumeBound,
+			helperNamespace: "helpers",
+			want:            ActionContinue,
+		},
+		{
+			name:            "not probed for this claim",
+			sc:              retire,
+			pv:              map[string]string{AnnotationUsageClaim: "previous-claim-uid", AnnotationUsageBytes: "1"},
+			helperNamespace: "helpers",
+			want:            ActionWait,
+			wantReason:      "waiting for helper PVC",
+		},
+		{
+			name:            "under the threshold",
+			sc:              retire,
+			pv:              probed("1024"),
+			helperNamespace: "helpers",
+			want:            ActionContinue,
+		},
+		{
+			name:            "over the threshold",
+			sc:              retire,
+			pv:              probed("1025"),
+			helperNamespace: "helpers",
+			want:            ActionRetire,
+			wantReason:      "used 1025 bytes",
+		},
+		{
+			name:            "over the threshold, not pruned yet",
+			sc:              prune,
+			pv:              probed("1025"),
+			helperNamespace: "helpers",
+			want:            ActionWait,
+			wantReason:      "waiting for helper PVC",
+		},
+		{
+			name:            "over the threshold, already pruned",
+			sc:              prune,
+			pv:              probed("1025", AnnotationPrunedClaim, "claim-uid"),
+			helperNamespace: "helpers",
+			want:            ActionContinue,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pv := usageTestPV(test.pv)
+			if test.phase != "" {
+				pv.Status.Phase = test.phase
+			}
+			r := &Releaser{
+				BasicController: controller.BasicController{
+					Ctx:           context.Background(),
+					ControllerId:  "test",
+					KubeClientSet: fake.NewSimpleClientset(pv),
+					Recorder:      record.NewFakeRecorder(10),
+				},
+				HelperNamespace: test.helperNamespace,
+			}
+
+			action, reason := r.usagePolicy(context.Background(), pv, usageTestSC(test.sc))
+			if action != test.want {
+				t.Errorf("expected %s, got %s: %s", test.want, action, reason)
+			}
+			if !strings.Contains(reason, test.wantReason) {
+				t.Errorf("expected reason to contain %q, got %q", test.wantReason, reason)
+			}
+		})
+	}
+}